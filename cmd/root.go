@@ -5,25 +5,59 @@ Copyright © 2021 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/myml/webssh/common"
 	"github.com/myml/webssh/dcv"
 	webssh "github.com/myml/webssh/ssh"
 	"github.com/myml/webssh/vnc"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
 )
 
 var (
-	web  string
-	port uint16
+	cfgFile string
+
+	// config keys of the flags
+	flagKeys = map[string]string{
+		"listen":               "listen",
+		"port":                 "port",
+		"web":                  "web",
+		"idle":                 "idle",
+		"metrics_path":         "metrics-path",
+		"drain_timeout":        "drain-timeout",
+		"allowed_origins":      "allowed-origin",
+		"ssh.known_hosts":      "known-hosts",
+		"ssh.host_key_policy":  "host-key-policy",
+		"ssh.record_dir":       "record-dir",
+		"ssh.record_input":     "record-input",
+		"ssh.sftp_policy":      "sftp-policy",
+		"ssh.sftp_audit":       "sftp-audit",
+		"ssh.tunnel_ports":     "tunnel-port",
+		"ssh.agent_forwarding": "agent-forwarding",
+		"ssh.x11_forwarding":   "x11-forwarding",
+		"ssh.empty_password":   "empty-password",
+		"ssh.max_channels":     "max-channels",
+		"vnc.record_dir":       "vnc-record-dir",
+		"tls.cert":             "tls-cert",
+		"tls.key":              "tls-key",
+		"tls.client_ca":        "tls-client-ca",
+		"tls.redirect_port":    "tls-redirect-port",
+	}
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -52,127 +86,526 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.webssh.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.webssh.yaml)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
-	rootCmd.Flags().Uint16VarP(&port, "port", "p", 80, "port to listen on")
-	rootCmd.Flags().StringVar(&web, "web", "", "web dir to serve")
-	rootCmd.Flags().IntVarP(&common.IdleTime, "idle", "", 30, "idle time waited")
+	rootCmd.Flags().String("listen", "", "address to listen on")
+	rootCmd.Flags().Uint16P("port", "p", 80, "port to listen on")
+	rootCmd.Flags().String("web", "", "web dir to serve")
+	rootCmd.Flags().Int("idle", 30, "idle time waited")
+	rootCmd.Flags().String("metrics-path", "/metrics", "path serving prometheus metrics, empty to disable")
+	rootCmd.Flags().Duration("drain-timeout", 30*time.Second, "time waited for sessions to close on SIGTERM")
+	rootCmd.Flags().StringSlice("allowed-origin", nil, "origin allowed to open websockets, e.g. https://example.com or *.example.com (default all)")
+	rootCmd.Flags().String("known-hosts", common.DefaultKnownHosts(), "known_hosts file of ssh targets")
+	rootCmd.Flags().String("host-key-policy", string(webssh.HostKeyTOFU), "ssh host key policy: tofu, strict or insecure")
+	rootCmd.Flags().String("record-dir", "", "dir to keep asciinema recordings of ssh sessions")
+	rootCmd.Flags().Bool("record-input", false, "record ssh user input as well")
+	rootCmd.Flags().String("vnc-record-dir", "", "dir to keep noVNC recordings of vnc sessions")
+	rootCmd.Flags().String("sftp-policy", "", "sftp policy json file (default denies reading files)")
+	rootCmd.Flags().String("sftp-audit", "", "json lines file auditing sftp operations, - for stdout")
+	rootCmd.Flags().Bool("agent-forwarding", false, "let clients forward their ssh agent to the shell")
+	rootCmd.Flags().Bool("x11-forwarding", false, "let clients forward x11 to the browser")
+	rootCmd.Flags().Bool("empty-password", false, "try an empty ssh password before asking the browser")
+	rootCmd.Flags().Int("max-channels", 8, "terminals and commands a websocket may open besides the main terminal")
+	rootCmd.Flags().IntSlice("tunnel-port", nil, "port on the vm /tunnel may reach, repeat for more (default none)")
+	rootCmd.Flags().String("tls-cert", "", "tls certificate file, enables https and wss")
+	rootCmd.Flags().String("tls-key", "", "tls private key file")
+	rootCmd.Flags().String("tls-client-ca", "", "ca bundle verifying client certificates")
+	rootCmd.Flags().Uint16("tls-redirect-port", 0, "plain http port redirecting to https")
 }
 
 func serve(cmd *cobra.Command, args []string) {
-	if web != "" {
-		web, err := filepath.Abs(web)
+	config, err := common.LoadConfig(cfgFile, cmd.Flags(), flagKeys)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		log.Fatalf("config: %s", err)
+	}
+	if err = common.Configure(config); err != nil {
+		log.Fatalf("config: %s", err)
+	}
+	if !common.OriginsRestricted() {
+		log.Printf("websockets accepted from any origin as allowed_origins is empty, vnc token cookie ignored")
+	}
+	webssh.RecordDir = config.SSH.RecordDir
+	webssh.RecordInput = config.SSH.RecordInput
+	webssh.ScrollbackSize = config.SSH.Scrollback
+	webssh.DetachGrace = config.SSH.DetachGrace
+	webssh.DetachBuffer = config.SSH.DetachBuffer
+	webssh.ExecTimeout = config.SSH.ExecTimeout
+	webssh.ExecOutput = config.SSH.ExecOutput
+	webssh.TunnelPorts = config.SSH.TunnelPorts
+	webssh.TunnelHosts = config.SSH.TunnelHosts
+	webssh.MaxChannels = config.SSH.MaxChannels
+	vnc.RecordDir = config.VNC.RecordDir
+	vnc.RecordMaxSize = config.VNC.RecordMaxSize
+	vnc.RecordMaxFiles = config.VNC.RecordMaxFiles
+	if config.VNC.CAFile != "" {
+		if err = vnc.LoadRootCAs(config.VNC.CAFile); err != nil {
+			log.Fatalf("config: %s", err)
+		}
+	}
+
+	knownHosts, err := webssh.NewKnownHosts(config.SSH.KnownHosts, webssh.HostKeyPolicy(config.SSH.HostKeyPolicy))
+	if err != nil {
+		log.Fatalf("host key verification: %s", err)
+	}
+	sftpPolicy := webssh.DefaultSftpPolicy()
+	if config.SSH.SftpPolicy != "" {
+		if sftpPolicy, err = webssh.LoadSftpPolicy(config.SSH.SftpPolicy); err != nil {
+			log.Fatalf("sftp policy: %s", err)
+		}
+	}
+	var sftpAudit *webssh.SftpAudit
+	if config.SSH.SftpAudit != "" {
+		if sftpAudit, err = webssh.NewSftpAudit(config.SSH.SftpAudit); err != nil {
+			log.Fatalf("sftp audit: %s", err)
+		}
+	}
+
+	if config.Web != "" {
+		web, err := filepath.Abs(config.Web)
 		if err == nil {
 			http.Handle("/", http.FileServer(http.Dir(web)))
 		}
 	}
+	if config.MetricsPath != "" {
+		http.Handle(config.MetricsPath, promhttp.Handler())
+	}
+	if config.Admin.Token != "" {
+		prefix := strings.TrimSuffix(config.Admin.Path, "/")
+		http.Handle(prefix+"/", common.AdminHandler(prefix, config.Admin.Token))
+	}
 	http.HandleFunc("/ssh", func(w http.ResponseWriter, r *http.Request) {
-		id := r.Header.Get("Sec-WebSocket-Key")
+		id := common.NewSessionID()
 		token := r.URL.Query().Get("token")
 		user := r.URL.Query().Get("user")
 
-		if user == "" || token == "" {
+		if token == "" {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 
 		logger := log.New(os.Stdout, "["+id+"] ", log.Ltime|log.Ldate)
-		wssh := webssh.NewWebSSH(logger)
+		if !common.CheckOrigin(r) {
+			logger.Printf("ssh origin %s rejected", r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 
-		conn, err, respCode := common.GetTargetConn(token, 22)
-		if conn == nil {
-			logger.Printf("ssh get target connection failed with %d(%s)", respCode, err)
-			if respCode == 0 {
-				respCode = http.StatusInternalServerError
+		//the token must still lead to the vm of the session joined
+		sameTarget := func(addr net.Addr) bool {
+			target, err, respCode := common.GetTarget(token)
+			if target == nil {
+				logger.Printf("ssh get target failed with %d(%s)", respCode, err)
+				if respCode == 0 {
+					respCode = http.StatusInternalServerError
+				}
+				w.WriteHeader(respCode)
+				return false
+			}
+			if host, _, _ := net.SplitHostPort(addr.String()); host != target.Ip {
+				logger.Printf("ssh target %s changed to %s", host, target.Ip)
+				w.WriteHeader(http.StatusForbidden)
+				return false
 			}
+			return true
+		}
+
+		//attach to a live session of the same token
+		if share := r.URL.Query().Get("session"); share != "" {
+			mode := r.URL.Query().Get("mode")
+			if mode != webssh.ShareCopilot {
+				mode = webssh.ShareObserve
+			}
+			wssh := webssh.Shared(share, token)
+			if wssh == nil {
+				logger.Printf("ssh session to attach not found")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			//joining takes the consent of the owner or an administrator
+			if !wssh.Joinable(mode) && !common.AdminAuthorized(r, config.Admin.Token) {
+				logger.Printf("ssh %s not allowed by the session", mode)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if !sameTarget(wssh.Target()) {
+				return
+			}
+			ws, err := common.Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": []string{"webssh"}})
 			if err != nil {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.WriteHeader(respCode)
+				logger.Printf("ssh upgrade websocket failed %s", err)
+				return
+			}
+			tracked := common.Register("ssh", id, token, wssh.Target(), ws)
+			if tracked == nil {
+				return
+			}
+			if err = wssh.Attach(ws, mode, tracked, logger); err != nil {
+				logger.Printf("ssh attach failed %s", err)
+				common.Shutdown(ws, "attach failed")
+				ws.Close()
+				tracked.Done()
+			}
+			return
+		}
 
-				w.Write([]byte(err.Error()))
-			} else {
-				w.WriteHeader(respCode)
+		//reattach to a session detached on websocket loss
+		if resume := r.URL.Query().Get("resume"); resume != "" {
+			wssh := webssh.Resumable(resume, token)
+			if wssh == nil {
+				logger.Printf("ssh session to resume not found")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if !sameTarget(wssh.Target()) {
+				return
+			}
+			ws, err := common.Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": []string{"webssh"}})
+			if err != nil {
+				logger.Printf("ssh upgrade websocket failed %s", err)
+				return
+			}
+			tracked := common.Register("ssh", id, token, wssh.Target(), ws)
+			if tracked == nil {
+				return
 			}
+			if err = wssh.Resume(ws, tracked); err != nil {
+				logger.Printf("ssh resume failed %s", err)
+				common.Shutdown(ws, "resume failed")
+				ws.Close()
+				tracked.Done()
+			}
+			return
+		}
+		wssh := webssh.NewWebSSH(logger)
+		wssh.SetSession(id, token).SetBuffSize(config.SSH.BufferSize)
+
+		conn, target, _ := common.ConnectTarget(w, logger, "ssh", token, common.Port(config.Ports.SSH))
+		if conn == nil {
 			return
 		}
 
+		upgradeHeader := http.Header{"Sec-Websocket-Protocol": []string{"webssh"}}
+		ws, err := common.Upgrade(w, r, upgradeHeader)
+		if err != nil {
+			logger.Printf("ssh upgrade websocket failed %s", err)
+			conn.Close()
+			return
+		}
+		tracked := common.Register("ssh", id, token, conn.RemoteAddr(), ws)
+		if tracked == nil {
+			conn.Close()
+			return
+		}
+		wssh.AddWebsocket(ws)
+		wssh.Track(tracked)
+		wssh.SetSftpPolicy(sftpPolicy, target.Scope)
+		wssh.SetSftpAudit(sftpAudit)
+		wssh.SetShare(r.URL.Query().Get("share"))
+		wssh.SetEmptyPassword(config.SSH.EmptyPassword)
+		if agent, _ := strconv.ParseBool(r.URL.Query().Get("agent")); agent && config.SSH.AgentForwarding {
+			wssh.SetAgentForwarding(true)
+		}
+		if x11, _ := strconv.ParseBool(r.URL.Query().Get("x11")); x11 && config.SSH.X11Forwarding {
+			wssh.SetX11Forwarding(true)
+		}
+
 		config := ssh.ClientConfig{
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback: wssh.VerifyHostKey(knownHosts.HostKeyCallback(target.HostKey)),
 			User:            user,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(""),
-			},
-			BannerCallback: wssh.BannerDisplay,
+			Auth:            wssh.AuthMethods(),
+			BannerCallback:  wssh.BannerDisplay,
 		}
+		wssh.Connect(conn, &config)
+	})
+	http.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
+		id := common.NewSessionID()
+		token := r.URL.Query().Get("token")
+		upgrade := r.Header.Get("Upgrade") != ""
 
-		err = wssh.NewSSHClient(conn, &config)
-		if err == nil {
-			err = wssh.NewSSHXtermSession()
+		if token == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		logger := log.New(os.Stdout, "["+id+"] ", log.Ltime|log.Ldate)
+		var req webssh.ExecRequest
+		var auth []ssh.AuthMethod
+		if upgrade {
+			if !common.CheckOrigin(r) {
+				logger.Printf("exec origin %s rejected", r.Header.Get("Origin"))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			req.User = r.URL.Query().Get("user")
+			req.Timeout, _ = strconv.Atoi(r.URL.Query().Get("timeout"))
+		} else {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			//json only, so browsers preflight cross origin requests
+			if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&req)
+			if err == nil && (req.User == "" || req.Command == "") {
+				err = errors.New("user and command required")
+			}
 			if err == nil {
-				err = wssh.NewSftpSession()
+				auth, err = req.AuthMethods()
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 		}
 
-		if err != nil {
-			logger.Printf("ssh create sessions failed %s", err)
-
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
+		conn, target, _ := common.ConnectTarget(w, logger, "exec", token, common.Port(config.Ports.SSH))
+		if conn == nil {
+			return
+		}
 
+		wssh := webssh.NewWebSSH(logger)
+		wssh.SetSession(id, token).SetBuffSize(config.SSH.BufferSize)
+		if !upgrade {
+			//killing the session drops the ssh connection, ending the command
+			tracked := common.RegisterRequest("exec", id, token, conn.RemoteAddr(), r.RemoteAddr, func() { conn.Close() })
+			if tracked == nil {
+				conn.Close()
+				http.Error(w, "server restarting", http.StatusServiceUnavailable)
+				return
+			}
+			wssh.Track(tracked)
+			config := ssh.ClientConfig{
+				HostKeyCallback: knownHosts.HostKeyCallback(target.HostKey),
+				User:            req.User,
+				Auth:            auth,
+			}
+			if err = wssh.NewSSHClient(conn, &config); err != nil {
+				logger.Printf("exec ssh connect failed %s", err)
+				conn.Close()
+				tracked.Done()
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			res := wssh.Run(req.Command, webssh.ExecTimeoutOf(req.Timeout))
 			wssh.Cleanup()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(res)
 			return
 		}
 
 		upgradeHeader := http.Header{"Sec-Websocket-Protocol": []string{"webssh"}}
 		ws, err := common.Upgrade(w, r, upgradeHeader)
 		if err != nil {
-			logger.Printf("ssh upgrade websocket failed %s", err)
-			wssh.Cleanup()
+			logger.Printf("exec upgrade websocket failed %s", err)
+			conn.Close()
+			return
+		}
+		tracked := common.Register("exec", id, token, conn.RemoteAddr(), ws)
+		if tracked == nil {
+			conn.Close()
 			return
 		}
 		wssh.AddWebsocket(ws)
+		wssh.Track(tracked)
+		wssh.SetEmptyPassword(config.SSH.EmptyPassword)
+
+		config := ssh.ClientConfig{
+			HostKeyCallback: wssh.VerifyHostKey(knownHosts.HostKeyCallback(target.HostKey)),
+			User:            req.User,
+			Auth:            wssh.AuthMethods(),
+			BannerCallback:  wssh.BannerDisplay,
+		}
+		wssh.Exec(conn, &config, webssh.ExecTimeoutOf(req.Timeout))
 	})
-	http.HandleFunc("/vnc", func(w http.ResponseWriter, r *http.Request) {
-		id := r.Header.Get("Sec-WebSocket-Key")
+	http.HandleFunc("/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		id := common.NewSessionID()
 		token := r.URL.Query().Get("token")
+		user := r.URL.Query().Get("user")
+		host := r.URL.Query().Get("host")
+		port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
+
 		if token == "" {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		if host == "" {
+			host = "localhost"
+		}
+		if err != nil || port == 0 {
+			http.Error(w, "port invalid", http.StatusBadRequest)
+			return
+		}
 
 		logger := log.New(os.Stdout, "["+id+"] ", log.Ltime|log.Ldate)
+		if !common.CheckOrigin(r) {
+			logger.Printf("tunnel origin %s rejected", r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !webssh.TunnelAllowed(host, uint16(port)) {
+			logger.Printf("tunnel to %s:%d not allowed", host, port)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 
-		conn, err, respCode := common.GetTargetConn(token, 5901)
+		conn, target, _ := common.ConnectTarget(w, logger, "tunnel", token, common.Port(config.Ports.SSH))
 		if conn == nil {
-			logger.Printf("vnc get target connection failed with %d(%s)", respCode, err)
-			if respCode == 0 {
-				respCode = http.StatusInternalServerError
-			}
-			if err != nil {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.WriteHeader(respCode)
+			return
+		}
 
-				w.Write([]byte(err.Error()))
-			} else {
-				w.WriteHeader(respCode)
-			}
+		upgradeHeader := http.Header{"Sec-Websocket-Protocol": []string{"webssh"}}
+		ws, err := common.Upgrade(w, r, upgradeHeader)
+		if err != nil {
+			logger.Printf("tunnel upgrade websocket failed %s", err)
+			conn.Close()
+			return
+		}
+		tracked := common.Register("tunnel", id, token, conn.RemoteAddr(), ws)
+		if tracked == nil {
+			conn.Close()
+			return
+		}
+		wssh := webssh.NewWebSSH(logger)
+		wssh.SetSession(id, token).SetBuffSize(config.SSH.BufferSize)
+		wssh.AddWebsocket(ws)
+		wssh.Track(tracked)
+		wssh.SetEmptyPassword(config.SSH.EmptyPassword)
+
+		config := ssh.ClientConfig{
+			HostKeyCallback: wssh.VerifyHostKey(knownHosts.HostKeyCallback(target.HostKey)),
+			User:            user,
+			Auth:            wssh.AuthMethods(),
+			BannerCallback:  wssh.BannerDisplay,
+		}
+		wssh.Tunnel(conn, &config, host, uint16(port))
+	})
+	http.HandleFunc("/x11", func(w http.ResponseWriter, r *http.Request) {
+		id := common.NewSessionID()
+		token := r.URL.Query().Get("token")
+		x11 := r.URL.Query().Get("id")
+
+		if token == "" || x11 == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		logger := log.New(os.Stdout, "["+id+"] ", log.Ltime|log.Ldate)
+		if !common.CheckOrigin(r) {
+			logger.Printf("x11 origin %s rejected", r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		wssh := webssh.X11Session(x11, token)
+		if wssh == nil {
+			logger.Printf("x11 connection to attach not found")
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
 		ws, err := common.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Printf("x11 upgrade websocket failed %s", err)
+			return
+		}
+		tracked := common.Register("x11", id, token, wssh.Target(), ws)
+		if tracked == nil {
+			return
+		}
+		if err = wssh.AttachX11(ws, x11, tracked); err != nil {
+			logger.Printf("x11 attach failed %s", err)
+			common.Shutdown(ws, "attach failed")
+			ws.Close()
+			tracked.Done()
+		}
+	})
+	//the port of the token, or the default one
+	vncPort := func(target *common.VmInfo) uint16 {
+		if target.VNCPort != 0 {
+			return target.VNCPort
+		}
+		return config.Ports.VNC
+	}
+	handleVNC := func(w http.ResponseWriter, r *http.Request) {
+		id := common.NewSessionID()
+		token := vnc.Token(r)
+		if token == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		logger := log.New(os.Stdout, "["+id+"] ", log.Ltime|log.Ldate)
+		if !common.CheckOrigin(r) {
+			logger.Printf("vnc origin %s rejected", r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		protocol, err := vnc.Subprotocol(r)
+		if err != nil {
+			logger.Printf("vnc %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conn, target, _ := common.ConnectTarget(w, logger, "vnc", token, vncPort)
+		if conn == nil {
+			return
+		}
+
+		//the query may restrict the token to view only, never the reverse
+		viewOnly, _ := strconv.ParseBool(r.URL.Query().Get("view_only"))
+		opts := &vnc.Options{ViewOnly: viewOnly || target.VNCViewOnly, Clipboard: &config.Clipboard}
+		//without password the handshake is relayed, as the messages are
+		//filtered by the proxy when the policy requires it
+		if target.VNCPassword != "" {
+			//keep the vnc password away from the browser
+			redial := func() (net.Conn, error) {
+				c, err, _ := common.DialTarget(target, vncPort(target))
+				return c, err
+			}
+			if conn, err = vnc.ServerAuth(conn, redial, target.VNCUser, target.VNCPassword, common.DialTimeout); err != nil {
+				logger.Printf("vnc server authentication failed %s", err)
+				common.DialFailed("vnc", http.StatusBadGateway)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			opts.Authenticated = true
+		}
+
+		var upgradeHeader http.Header
+		if protocol != "" {
+			upgradeHeader = http.Header{"Sec-Websocket-Protocol": []string{protocol}}
+		}
+		ws, err := common.Upgrade(w, r, upgradeHeader)
 		if err != nil {
 			logger.Printf("vnc upgrade websocket failed %s", err)
 			conn.Close()
 			return
 		}
 
-		go vnc.Proxy(logger, ws, conn)
-	})
+		tracked := common.Register("vnc", id, token, conn.RemoteAddr(), ws)
+		if tracked == nil {
+			conn.Close()
+			return
+		}
+		go func() {
+			vnc.Proxy(logger, ws, conn, tracked, opts)
+			tracked.Done()
+		}()
+	}
+	//token in the query, or in the path as websockify clients send it
+	http.HandleFunc("/vnc", handleVNC)
+	http.HandleFunc("/vnc/", handleVNC)
+	http.HandleFunc("/websockify", handleVNC)
 	http.HandleFunc("/dcv/", func(w http.ResponseWriter, r *http.Request) {
-		id := r.Header.Get("Sec-WebSocket-Key")
+		id := common.NewSessionID()
 		ss := strings.SplitN(r.URL.Path, "/", 4)
 		if len(ss) < 3 || ss[2] == "" {
 			w.WriteHeader(http.StatusForbidden)
@@ -185,6 +618,27 @@ func serve(cmd *cobra.Command, args []string) {
 		}
 
 		logger := log.New(os.Stdout, "["+id+"/"+path+"] ", log.Ltime|log.Ldate)
+		if !common.CheckOrigin(r) {
+			logger.Printf("dcv origin %s rejected", r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		//the clipboard has a websocket of its own, only its messages may be denied
+		clipboard := false
+		if r.Header.Get("Upgrade") != "" && config.Clipboard.Denied() {
+			var ok bool
+			if clipboard, ok = dcv.IsChannel(path, config.Clipboard.DCVChannel); !ok {
+				logger.Printf("dcv channel %q unknown while the clipboard is denied", path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		//only the input and clipboard channels carry user input
+		input, _ := dcv.IsChannel(path, dcv.InputChannel)
+		if paste, _ := dcv.IsChannel(path, config.Clipboard.DCVChannel); paste {
+			input = true
+		}
 
 		connBackend, rsp, err := common.Client(token, path, r)
 		if connBackend == nil || err != nil {
@@ -192,6 +646,7 @@ func serve(cmd *cobra.Command, args []string) {
 				logger.Printf("dcv get target connection failed with (%s)", err)
 			}
 			if rsp != nil {
+				common.DialFailed("dcv", rsp.StatusCode)
 				for k, vv := range rsp.Header {
 					for _, v := range vv {
 						w.Header().Add(k, v)
@@ -202,6 +657,7 @@ func serve(cmd *cobra.Command, args []string) {
 				io.Copy(w, rsp.Body)
 
 			} else {
+				common.DialFailed("dcv", http.StatusBadRequest)
 				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 				w.WriteHeader(http.StatusBadRequest)
 
@@ -224,7 +680,63 @@ func serve(cmd *cobra.Command, args []string) {
 			return
 		}
 
-		go dcv.Proxy(logger, connFrontend, connBackend)
+		tracked := common.Register("dcv", id, token, connBackend.RemoteAddr(), connFrontend)
+		if tracked == nil {
+			connBackend.Close()
+			return
+		}
+		var hook dcv.Hook
+		if clipboard {
+			hook = dcv.ClipboardHook(logger, &config.Clipboard)
+		}
+		go func() {
+			dcv.Proxy(logger, connFrontend, connBackend, tracked, input, hook)
+			tracked.Done()
+		}()
 	})
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+
+	server := &http.Server{Addr: net.JoinHostPort(config.Listen, strconv.Itoa(int(config.Port)))}
+	servers := []*http.Server{server}
+	listen := server.ListenAndServe
+	if config.TLS.Cert != "" {
+		certs, err := common.NewCertReloader(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA)
+		if err != nil {
+			log.Fatalf("tls: %s", err)
+		}
+		server.TLSConfig = certs.TLSConfig(config.TLS.ClientAuthType())
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+		if config.TLS.RedirectPort != 0 {
+			redirect := &http.Server{
+				Addr:    net.JoinHostPort(config.Listen, strconv.Itoa(int(config.TLS.RedirectPort))),
+				Handler: common.RedirectHandler(config.Port),
+			}
+			servers = append(servers, redirect)
+			go serveUntilShutdown(redirect.ListenAndServe)
+		}
+	}
+	go serveUntilShutdown(listen)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	log.Printf("received %s, draining sessions", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	//stop accepting, hijacked websockets are not waited by Shutdown
+	for _, s := range servers {
+		go s.Shutdown(ctx)
+	}
+	if n := common.Drain(ctx); n > 0 {
+		log.Printf("drain timeout, %d sessions closed", n)
+	}
+	if sftpAudit != nil {
+		sftpAudit.Close()
+	}
+	log.Printf("exit")
+}
+
+func serveUntilShutdown(listen func() error) {
+	if err := listen(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdminHandler serves the admin api under prefix, authenticated by a bearer token
+//
+//	GET    prefix/sessions[?kind=&token=&target=]  list live sessions
+//	DELETE prefix/sessions/{id}                    terminate one session
+//	DELETE prefix/sessions?token=|target=          terminate the sessions of a token or target ip
+func AdminHandler(prefix, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !AdminAuthorized(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		q := r.URL.Query()
+		switch {
+		case path == "/sessions" && r.Method == http.MethodGet:
+			list := matchSessions(q.Get("kind"), q.Get("token"), q.Get("target"))
+			infos := make([]*SessionInfo, 0, len(list))
+			for _, s := range list {
+				infos = append(infos, s.Info())
+			}
+			sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+			writeAdmin(w, http.StatusOK, infos)
+		case path == "/sessions" && r.Method == http.MethodDelete:
+			if q.Get("token") == "" && q.Get("target") == "" {
+				http.Error(w, "token or target required", http.StatusBadRequest)
+				return
+			}
+			list := matchSessions(q.Get("kind"), q.Get("token"), q.Get("target"))
+			if q.Get("token") != "" {
+				//the token may have been revoked, check it again on reconnect
+				Invalidate(q.Get("token"))
+			}
+			killSessions(r, list)
+			writeAdmin(w, http.StatusOK, map[string]int{"killed": len(list)})
+		case strings.HasPrefix(path, "/sessions/") && r.Method == http.MethodDelete:
+			id := strings.TrimPrefix(path, "/sessions/")
+			var list []*Session
+			for _, s := range Sessions() {
+				if s.ID == id {
+					list = append(list, s)
+				}
+			}
+			if len(list) == 0 {
+				http.Error(w, "session not found", http.StatusNotFound)
+				return
+			}
+			killSessions(r, list)
+			writeAdmin(w, http.StatusOK, map[string]int{"killed": len(list)})
+		case path == "/sessions" || strings.HasPrefix(path, "/sessions/"):
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// AdminAuthorized report whether r bears the admin token
+func AdminAuthorized(r *http.Request, token string) bool {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(auth), []byte(token)) == 1
+}
+
+func matchSessions(kind, token, target string) []*Session {
+	var list []*Session
+	for _, s := range Sessions() {
+		if kind != "" && s.Kind != kind || token != "" && s.Token != token || target != "" && s.Target != target {
+			continue
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+func killSessions(r *http.Request, list []*Session) {
+	for _, s := range list {
+		log.Printf("admin %s killed %s session %s of %s", r.RemoteAddr, s.Kind, s.ID, s.Target)
+		s.Kill("killed by administrator")
+	}
+}
+
+func writeAdmin(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type cacheEntry struct {
+	info   *VmInfo
+	expire time.Time
+}
+
+// cachingResolver caches the results of next by token, tokens not found are
+// cached for negativeTTL, errors are never cached
+type cachingResolver struct {
+	next        Resolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	//bumped by Invalidate, lookups started before are not cached
+	gen   uint64
+	swept time.Time
+	group singleflight.Group
+}
+
+func newCachingResolver(next Resolver, ttl, negativeTTL time.Duration) *cachingResolver {
+	return &cachingResolver{
+		next:        next,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*cacheEntry),
+		swept:       time.Now(),
+	}
+}
+
+func (r *cachingResolver) get(token string) (*cacheEntry, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[token]
+	if ok && time.Now().Before(e.expire) {
+		return e, r.gen
+	}
+	return nil, r.gen
+}
+
+func (r *cachingResolver) set(token string, info *VmInfo, gen uint64) {
+	ttl := r.ttl
+	if info == nil {
+		ttl = r.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gen != r.gen {
+		return
+	}
+	now := time.Now()
+	r.entries[token] = &cacheEntry{info: info, expire: now.Add(ttl)}
+
+	//drop expired tokens from time to time
+	if now.Sub(r.swept) > r.ttl+r.negativeTTL {
+		for k, e := range r.entries {
+			if now.After(e.expire) {
+				delete(r.entries, k)
+			}
+		}
+		r.swept = now
+	}
+}
+
+func (r *cachingResolver) Resolve(token string) (*VmInfo, error) {
+	e, gen := r.get(token)
+	if e == nil {
+		v, err, _ := r.group.Do(token, func() (interface{}, error) {
+			info, err := r.next.Resolve(token)
+			if err != nil {
+				return nil, err
+			}
+			e := &cacheEntry{info: info}
+			r.set(token, info, gen)
+			return e, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		e = v.(*cacheEntry)
+	}
+	if e.info == nil {
+		return nil, nil
+	}
+	//callers may change their copy
+	info := *e.info
+	return &info, nil
+}
+
+// Invalidate drop the cached result of token
+func (r *cachingResolver) Invalidate(token string) {
+	r.mu.Lock()
+	delete(r.entries, token)
+	r.gen++
+	r.mu.Unlock()
+	r.group.Forget(token)
+}
+
+// Invalidate drop the cached result of token so the next lookup asks the
+// resolver again, e.g. after the vm of the token has moved
+func Invalidate(token string) {
+	if resolverCache != nil {
+		resolverCache.Invalidate(token)
+	}
+}
@@ -0,0 +1,161 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedResolver answer lookup n with ip 10.0.0.n once gates[n-1] is closed,
+// or not found when found is false
+type gatedResolver struct {
+	found   bool
+	started chan int
+	gates   []chan struct{}
+
+	mu    sync.Mutex
+	calls int
+}
+
+func newGatedResolver(found bool, n int) *gatedResolver {
+	r := &gatedResolver{found: found, started: make(chan int, n)}
+	for i := 0; i < n; i++ {
+		r.gates = append(r.gates, make(chan struct{}))
+	}
+	return r
+}
+
+func (r *gatedResolver) Resolve(token string) (*VmInfo, error) {
+	r.mu.Lock()
+	r.calls++
+	n := r.calls
+	r.mu.Unlock()
+	r.started <- n
+	<-r.gates[n-1]
+	if !r.found {
+		return nil, nil
+	}
+	return &VmInfo{Ip: fmt.Sprintf("10.0.0.%d", n)}, nil
+}
+
+func (r *gatedResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func TestCachingResolverExpire(t *testing.T) {
+	tests := []struct {
+		name        string
+		found       bool
+		ttl         time.Duration
+		negativeTTL time.Duration
+		//lookups reaching the resolver by a second Resolve right away and a
+		//third one after 50ms
+		calls []int
+	}{
+		{"cached", true, time.Hour, 0, []int{1, 1}},
+		{"expired", true, 20 * time.Millisecond, time.Hour, []int{1, 2}},
+		{"not found cached", false, 0, time.Hour, []int{1, 1}},
+		{"not found expired", false, time.Hour, 20 * time.Millisecond, []int{1, 2}},
+		{"not found uncached", false, time.Hour, 0, []int{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := newGatedResolver(tt.found, 3)
+			for _, g := range next.gates {
+				close(g)
+			}
+			r := newCachingResolver(next, tt.ttl, tt.negativeTTL)
+			r.Resolve("t")
+			for i, calls := range tt.calls {
+				if i > 0 {
+					time.Sleep(50 * time.Millisecond)
+				}
+				info, err := r.Resolve("t")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (info != nil) != tt.found {
+					t.Fatalf("info %v, want found %v", info, tt.found)
+				}
+				if n := next.count(); n != calls {
+					t.Fatalf("%d lookups, want %d", n, calls)
+				}
+			}
+		})
+	}
+}
+
+func TestCachingResolverInvalidate(t *testing.T) {
+	next := newGatedResolver(true, 3)
+	r := newCachingResolver(next, time.Hour, time.Hour)
+
+	resolve := func() chan string {
+		ip := make(chan string, 1)
+		go func() {
+			info, err := r.Resolve("t")
+			if err != nil || info == nil {
+				ip <- ""
+				return
+			}
+			ip <- info.Ip
+		}()
+		return ip
+	}
+
+	//a miss in flight while the token is invalidated
+	stale := resolve()
+	<-next.started
+	r.Invalidate("t")
+
+	//must not join the lookup started before
+	fresh := resolve()
+	if n := <-next.started; n != 2 {
+		t.Fatalf("lookup %d, want 2", n)
+	}
+	close(next.gates[0])
+	if ip := <-stale; ip != "10.0.0.1" {
+		t.Fatalf("stale lookup %q", ip)
+	}
+	close(next.gates[1])
+	if ip := <-fresh; ip != "10.0.0.2" {
+		t.Fatalf("fresh lookup %q", ip)
+	}
+
+	//the stale result is not cached, the fresh one is
+	if ip := <-resolve(); ip != "10.0.0.2" {
+		t.Fatalf("cached %q, want 10.0.0.2", ip)
+	}
+	if n := next.count(); n != 2 {
+		t.Fatalf("%d lookups, want 2", n)
+	}
+}
+
+func TestCachingResolverStaleAfterFresh(t *testing.T) {
+	next := newGatedResolver(true, 2)
+	r := newCachingResolver(next, time.Hour, time.Hour)
+
+	stale := make(chan struct{})
+	go func() {
+		r.Resolve("t")
+		close(stale)
+	}()
+	<-next.started
+	r.Invalidate("t")
+
+	//the fresh lookup ends first, the stale one must not replace it
+	close(next.gates[1])
+	if info, err := r.Resolve("t"); err != nil || info.Ip != "10.0.0.2" {
+		t.Fatalf("fresh lookup %v %v", info, err)
+	}
+	close(next.gates[0])
+	<-stale
+	if info, err := r.Resolve("t"); err != nil || info.Ip != "10.0.0.2" {
+		t.Fatalf("cached %v %v, want 10.0.0.2", info, err)
+	}
+	if n := next.count(); n != 2 {
+		t.Fatalf("%d lookups, want 2", n)
+	}
+}
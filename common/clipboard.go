@@ -0,0 +1,104 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+)
+
+// clipboard directions
+const (
+	//from the browser to the vm
+	ClipboardUpload = "upload"
+	//from the vm to the browser
+	ClipboardDownload = "download"
+)
+
+// clipboard rule policies
+const (
+	ClipboardAllow = "allow"
+	ClipboardDeny  = "deny"
+)
+
+// ClipboardConfig is the data-loss prevention policy of copy and paste
+// through vnc and dcv sessions
+type ClipboardConfig struct {
+	Upload   ClipboardRule `mapstructure:"upload"`
+	Download ClipboardRule `mapstructure:"download"`
+	//last path element of the dcv websocket carrying the clipboard
+	DCVChannel string `mapstructure:"dcv_channel"`
+}
+
+// ClipboardRule of one direction
+type ClipboardRule struct {
+	//allow or deny
+	Policy string `mapstructure:"policy"`
+	//longest text passed on in bytes, 0 for no limit, vnc only
+	MaxLength int `mapstructure:"max_length"`
+	//log the length and sha256 of every text, vnc only
+	LogHash bool `mapstructure:"log_hash"`
+}
+
+// Restricted report whether r does more than passing texts on
+func (r *ClipboardRule) Restricted() bool {
+	return r.Policy == ClipboardDeny || r.MaxLength > 0 || r.LogHash
+}
+
+func (r *ClipboardRule) Validate(dir string) error {
+	switch r.Policy {
+	case ClipboardAllow, ClipboardDeny:
+	default:
+		return fmt.Errorf("clipboard.%s.policy %q invalid, want allow or deny", dir, r.Policy)
+	}
+	if r.MaxLength < 0 {
+		return fmt.Errorf("clipboard.%s.max_length must not be negative", dir)
+	}
+	return nil
+}
+
+// Rule of direction dir
+func (c *ClipboardConfig) Rule(dir string) *ClipboardRule {
+	if dir == ClipboardUpload {
+		return &c.Upload
+	}
+	return &c.Download
+}
+
+// Restricted report whether any direction does more than passing texts on
+func (c *ClipboardConfig) Restricted() bool {
+	return c.Upload.Restricted() || c.Download.Restricted()
+}
+
+// Denied report whether any direction is denied
+func (c *ClipboardConfig) Denied() bool {
+	return c.Upload.Policy == ClipboardDeny || c.Download.Policy == ClipboardDeny
+}
+
+// Apply the rule of dir to text copied through a session of protocol, return
+// the text to pass on and false when it is dropped. Texts over the max length
+// are cut when truncate, dropped otherwise
+func (c *ClipboardConfig) Apply(logger *log.Logger, protocol, dir string, text []byte, truncate bool) ([]byte, bool) {
+	r := c.Rule(dir)
+	action := "allowed"
+	switch {
+	case r.Policy == ClipboardDeny:
+		action = "denied"
+	case r.MaxLength > 0 && len(text) > r.MaxLength && truncate:
+		action = "truncated"
+	case r.MaxLength > 0 && len(text) > r.MaxLength:
+		action = "denied"
+	}
+	clipboardTransfers.WithLabelValues(protocol, dir, action).Inc()
+	if r.LogHash {
+		logger.Printf("%s clipboard %s of %d bytes sha256 %x %s", protocol, dir, len(text), sha256.Sum256(text), action)
+	} else if action != "allowed" {
+		logger.Printf("%s clipboard %s of %d bytes %s", protocol, dir, len(text), action)
+	}
+	switch action {
+	case "denied":
+		return nil, false
+	case "truncated":
+		return text[:r.MaxLength], true
+	}
+	return text, true
+}
@@ -0,0 +1,449 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Config of webssh, loaded from config file, environment and flags in
+// increasing precedence
+type Config struct {
+	//address to listen on, empty for all interfaces
+	Listen string `mapstructure:"listen"`
+	Port   uint16 `mapstructure:"port"`
+	//web dir to serve
+	Web string `mapstructure:"web"`
+	//minutes without user input before disconnecting
+	Idle int `mapstructure:"idle"`
+	//websocket buffer size
+	BufferSize int `mapstructure:"buffer_size"`
+	//timeout connecting to the target vm
+	DialTimeout time.Duration `mapstructure:"dial_timeout"`
+	//path serving prometheus metrics, empty to disable
+	MetricsPath string `mapstructure:"metrics_path"`
+	//time waited for sessions to close on shutdown
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	//origins allowed to open websockets, e.g. https://example.com or *.example.com,
+	//empty allows all
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+
+	Ports    PortsConfig    `mapstructure:"ports"`
+	Resolver ResolverConfig `mapstructure:"resolver"`
+	SSH      SSHConfig      `mapstructure:"ssh"`
+	VNC      VNCConfig      `mapstructure:"vnc"`
+	TLS      TLSConfig      `mapstructure:"tls"`
+	Admin    AdminConfig    `mapstructure:"admin"`
+	//copy and paste through vnc and dcv sessions
+	Clipboard ClipboardConfig `mapstructure:"clipboard"`
+}
+
+// AdminConfig of the admin api, enabled when Token is set
+type AdminConfig struct {
+	Path  string `mapstructure:"path"`
+	Token string `mapstructure:"token"`
+}
+
+// TLSConfig terminates tls on the listener when Cert is set
+type TLSConfig struct {
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+	//ca bundle verifying client certificates
+	ClientCA string `mapstructure:"client_ca"`
+	//require or verify_if_given
+	ClientAuth string `mapstructure:"client_auth"`
+	//plain http port redirecting to https, 0 to disable
+	RedirectPort uint16 `mapstructure:"redirect_port"`
+}
+
+// ClientAuthType of the client_auth setting
+func (c *TLSConfig) ClientAuthType() tls.ClientAuthType {
+	if c.ClientAuth == "verify_if_given" {
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.RequireAndVerifyClientCert
+}
+
+func (c *TLSConfig) Validate() error {
+	if c.Cert == "" && c.Key == "" {
+		if c.ClientCA != "" || c.RedirectPort != 0 {
+			return errors.New("tls.client_ca and tls.redirect_port require tls.cert")
+		}
+		return nil
+	}
+	if c.Cert == "" || c.Key == "" {
+		return errors.New("tls.cert and tls.key must be set together")
+	}
+	switch c.ClientAuth {
+	case "", "require", "verify_if_given":
+	default:
+		return fmt.Errorf("tls.client_auth %q invalid, want require or verify_if_given", c.ClientAuth)
+	}
+	return nil
+}
+
+// PortsConfig are the backend ports on the target vm
+type PortsConfig struct {
+	SSH uint16 `mapstructure:"ssh"`
+	VNC uint16 `mapstructure:"vnc"`
+	DCV uint16 `mapstructure:"dcv"`
+}
+
+// ResolverConfig selects how tokens are resolved to vm ip
+type ResolverConfig struct {
+	//gateway, nacos, file or test
+	Type string `mapstructure:"type"`
+	//yaml map of token to vm info, used by the file resolver
+	File string `mapstructure:"file"`
+	//only resolved ips inside the cidr are accepted
+	AgentCIDR string        `mapstructure:"agent_cidr"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+	//use ip tokens directly, used for test only
+	Test    bool          `mapstructure:"test"`
+	Gateway GatewayConfig `mapstructure:"gateway"`
+	Nacos   NacosConfig   `mapstructure:"nacos"`
+	Cache   CacheConfig   `mapstructure:"cache"`
+}
+
+// CacheConfig of resolved tokens, zero ttl disables caching
+type CacheConfig struct {
+	TTL time.Duration `mapstructure:"ttl"`
+	//how long tokens not found are remembered
+	NegativeTTL time.Duration `mapstructure:"negative_ttl"`
+}
+
+// GatewayConfig is a fixed gateway address
+type GatewayConfig struct {
+	IP   string `mapstructure:"ip"`
+	Port uint16 `mapstructure:"port"`
+}
+
+// NacosConfig discovers the gateway from nacos
+type NacosConfig struct {
+	IP       string `mapstructure:"ip"`
+	Port     uint64 `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Service  string `mapstructure:"service"`
+	//where the nacos client keeps its service cache and logs
+	CacheDir string `mapstructure:"cache_dir"`
+	LogDir   string `mapstructure:"log_dir"`
+}
+
+// SSHConfig of ssh sessions
+type SSHConfig struct {
+	BufferSize    uint32 `mapstructure:"buffer_size"`
+	KnownHosts    string `mapstructure:"known_hosts"`
+	HostKeyPolicy string `mapstructure:"host_key_policy"`
+	SftpPolicy    string `mapstructure:"sftp_policy"`
+	SftpAudit     string `mapstructure:"sftp_audit"`
+	RecordDir     string `mapstructure:"record_dir"`
+	RecordInput   bool   `mapstructure:"record_input"`
+	//bytes of output replayed to websockets attaching to a session
+	Scrollback int `mapstructure:"scrollback"`
+	//time a session is kept after losing its websocket, 0 to end it at once
+	DetachGrace time.Duration `mapstructure:"detach_grace"`
+	//bytes of output kept for a detached session
+	DetachBuffer int `mapstructure:"detach_buffer"`
+	//longest time a command of the exec endpoint may run
+	ExecTimeout time.Duration `mapstructure:"exec_timeout"`
+	//bytes of output a command of the exec endpoint may write
+	ExecOutput int `mapstructure:"exec_output"`
+	//ports /tunnel may reach on the vm, none disables tunnels
+	TunnelPorts []uint16 `mapstructure:"tunnel_ports"`
+	//hosts /tunnel may reach from the vm, * for any
+	TunnelHosts []string `mapstructure:"tunnel_hosts"`
+	//let clients forward their ssh agent with agent=1
+	AgentForwarding bool `mapstructure:"agent_forwarding"`
+	//let clients forward x11 with x11=1
+	X11Forwarding bool `mapstructure:"x11_forwarding"`
+	//try an empty password before asking the browser, for legacy vms
+	EmptyPassword bool `mapstructure:"empty_password"`
+	//terminals and commands a websocket may open besides the main terminal
+	MaxChannels int `mapstructure:"max_channels"`
+}
+
+// VNCConfig of vnc sessions
+type VNCConfig struct {
+	//dir of the noVNC recordings of vnc sessions, empty to disable
+	RecordDir string `mapstructure:"record_dir"`
+	//bytes of a recording file before the next one is started
+	RecordMaxSize int64 `mapstructure:"record_max_size"`
+	//recording files of a session, the session is closed once all are full
+	RecordMaxFiles int `mapstructure:"record_max_files"`
+	//ca bundle pinning the VeNCrypt certificates of vms, empty to trust any
+	CAFile string `mapstructure:"ca_file"`
+}
+
+var defaults = map[string]interface{}{
+	"listen":                        "",
+	"web":                           "",
+	"port":                          80,
+	"idle":                          30,
+	"buffer_size":                   4096,
+	"dial_timeout":                  10 * time.Second,
+	"drain_timeout":                 30 * time.Second,
+	"metrics_path":                  "/metrics",
+	"allowed_origins":               []string{},
+	"ports.ssh":                     22,
+	"ports.vnc":                     5901,
+	"ports.dcv":                     8443,
+	"resolver.type":                 ResolverGateway,
+	"resolver.file":                 "",
+	"resolver.agent_cidr":           "",
+	"resolver.timeout":              10 * time.Second,
+	"resolver.test":                 false,
+	"resolver.cache.ttl":            30 * time.Second,
+	"resolver.cache.negative_ttl":   5 * time.Second,
+	"resolver.gateway.ip":           "",
+	"resolver.gateway.port":         0,
+	"resolver.nacos.ip":             "127.0.0.1",
+	"resolver.nacos.port":           8848,
+	"resolver.nacos.username":       "nacos",
+	"resolver.nacos.password":       "nacos",
+	"resolver.nacos.service":        "linyun-gateway",
+	"resolver.nacos.cache_dir":      "/var/cache/nacos",
+	"resolver.nacos.log_dir":        "/var/log/nacos",
+	"ssh.buffer_size":               256 * 1024,
+	"ssh.host_key_policy":           "tofu",
+	"ssh.sftp_policy":               "",
+	"ssh.sftp_audit":                "",
+	"ssh.record_dir":                "",
+	"ssh.record_input":              false,
+	"ssh.scrollback":                64 * 1024,
+	"ssh.detach_grace":              time.Minute,
+	"ssh.detach_buffer":             1024 * 1024,
+	"ssh.exec_timeout":              30 * time.Second,
+	"ssh.exec_output":               1024 * 1024,
+	"ssh.tunnel_ports":              []uint16{},
+	"ssh.tunnel_hosts":              []string{"localhost", "127.0.0.1", "::1"},
+	"ssh.agent_forwarding":          false,
+	"ssh.x11_forwarding":            false,
+	"ssh.empty_password":            false,
+	"ssh.max_channels":              8,
+	"vnc.record_dir":                "",
+	"vnc.record_max_size":           64 * 1024 * 1024,
+	"vnc.record_max_files":          16,
+	"vnc.ca_file":                   "",
+	"tls.cert":                      "",
+	"tls.key":                       "",
+	"tls.client_ca":                 "",
+	"tls.client_auth":               "require",
+	"tls.redirect_port":             0,
+	"admin.path":                    "/admin",
+	"admin.token":                   "",
+	"clipboard.upload.policy":       "allow",
+	"clipboard.upload.max_length":   0,
+	"clipboard.upload.log_hash":     false,
+	"clipboard.download.policy":     "allow",
+	"clipboard.download.max_length": 0,
+	"clipboard.download.log_hash":   false,
+	"clipboard.dcv_channel":         "clipboard",
+}
+
+// environment variables used before the configuration file existed
+var legacyEnv = map[string]string{
+	"resolver.agent_cidr":     "AGENT_CIDR",
+	"resolver.gateway.ip":     "SERVER_IP",
+	"resolver.gateway.port":   "SERVER_PORT",
+	"resolver.nacos.ip":       "NACOS_SERVER_IP",
+	"resolver.nacos.port":     "NACOS_SERVER_PORT",
+	"resolver.nacos.username": "NACOS_SERVER_USERNAME",
+	"resolver.nacos.password": "NACOS_SERVER_PASSWORD",
+}
+
+// DefaultKnownHosts is .webssh/known_hosts in the home dir
+func DefaultKnownHosts() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "known_hosts"
+	}
+	return filepath.Join(home, ".webssh", "known_hosts")
+}
+
+// LoadConfig read file, or .webssh.yaml in the home dir when file is empty,
+// then apply WEBSSH_* environment variables and the flags mapped to config keys
+func LoadConfig(file string, flags *pflag.FlagSet, keys map[string]string) (*Config, error) {
+	v := viper.New()
+	for k, d := range defaults {
+		v.SetDefault(k, d)
+	}
+	v.SetDefault("ssh.known_hosts", DefaultKnownHosts())
+
+	if file != "" {
+		v.SetConfigFile(file)
+	} else {
+		if home, err := os.UserHomeDir(); err == nil {
+			v.AddConfigPath(home)
+		}
+		v.SetConfigName(".webssh")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || file != "" {
+			return nil, fmt.Errorf("read config: %w", err)
+		}
+	}
+
+	v.SetEnvPrefix("webssh")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for k, env := range legacyEnv {
+		if err := v.BindEnv(k, "WEBSSH_"+strings.ToUpper(strings.NewReplacer(".", "_").Replace(k)), env); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, name := range keys {
+		if f := flags.Lookup(name); f != nil {
+			if err := v.BindPFlag(k, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	c := &Config{}
+	if err := v.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("decode config: %w", err)
+	}
+	//WEBSSH_TEST used to be enabled by its presence
+	if s, ok := os.LookupEnv("WEBSSH_TEST"); ok {
+		test, err := strconv.ParseBool(s)
+		c.Resolver.Test = test || err != nil
+	}
+	return c, nil
+}
+
+// Validate report the first invalid setting
+func (c *Config) Validate() error {
+	if c.Port == 0 {
+		return errors.New("port missing")
+	}
+	if c.Idle <= 0 {
+		return errors.New("idle must be positive")
+	}
+	if c.MetricsPath != "" && !strings.HasPrefix(c.MetricsPath, "/") {
+		return errors.New("metrics_path must start with /")
+	}
+	if c.Admin.Token != "" && !strings.HasPrefix(c.Admin.Path, "/") {
+		return errors.New("admin.path must start with /")
+	}
+	if c.DrainTimeout < 0 {
+		return errors.New("drain_timeout must not be negative")
+	}
+	if c.BufferSize < 512 {
+		return errors.New("buffer_size must be at least 512")
+	}
+	for _, o := range c.AllowedOrigins {
+		if _, err := parseOrigin(o); o != "*" && err != nil {
+			return err
+		}
+	}
+	if c.Ports.SSH == 0 || c.Ports.VNC == 0 || c.Ports.DCV == 0 {
+		return errors.New("ports.ssh, ports.vnc and ports.dcv must be set")
+	}
+	if c.SSH.BufferSize < 32*1024 {
+		return errors.New("ssh.buffer_size must be at least 32768")
+	}
+	if c.SSH.DetachGrace < 0 || c.SSH.DetachBuffer < 0 {
+		return errors.New("ssh.detach_grace and ssh.detach_buffer must not be negative")
+	}
+	if c.SSH.MaxChannels < 0 {
+		return errors.New("ssh.max_channels must not be negative")
+	}
+	if c.SSH.ExecTimeout <= 0 || c.SSH.ExecOutput <= 0 {
+		return errors.New("ssh.exec_timeout and ssh.exec_output must be positive")
+	}
+	if c.VNC.RecordMaxSize <= 0 || c.VNC.RecordMaxFiles <= 0 {
+		return errors.New("vnc.record_max_size and vnc.record_max_files must be positive")
+	}
+	switch c.SSH.HostKeyPolicy {
+	case "tofu", "strict", "insecure":
+	default:
+		return fmt.Errorf("ssh.host_key_policy %q invalid, want tofu, strict or insecure", c.SSH.HostKeyPolicy)
+	}
+	if c.SSH.HostKeyPolicy != "insecure" && c.SSH.KnownHosts == "" {
+		return errors.New("ssh.known_hosts missing")
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	if err := c.Clipboard.Upload.Validate(ClipboardUpload); err != nil {
+		return err
+	}
+	if err := c.Clipboard.Download.Validate(ClipboardDownload); err != nil {
+		return err
+	}
+	return c.Resolver.Validate()
+}
+
+// Validate the settings of the selected resolver
+func (c *ResolverConfig) Validate() error {
+	if c.Cache.TTL < 0 || c.Cache.NegativeTTL < 0 {
+		return errors.New("resolver.cache.ttl and resolver.cache.negative_ttl must not be negative")
+	}
+	switch c.Type {
+	case ResolverGateway, "":
+		if c.Test && c.Gateway.IP == "" {
+			return nil
+		}
+		if c.Gateway.IP == "" {
+			return errors.New("resolver.gateway.ip (SERVER_IP) missing")
+		}
+		if net.ParseIP(c.Gateway.IP) == nil {
+			return fmt.Errorf("resolver.gateway.ip %q format error", c.Gateway.IP)
+		}
+		if c.Gateway.Port == 0 {
+			return errors.New("resolver.gateway.port (SERVER_PORT) missing")
+		}
+		return c.validateCIDR()
+	case ResolverNacos:
+		if c.Nacos.IP == "" || c.Nacos.Port == 0 || c.Nacos.Service == "" {
+			return errors.New("resolver.nacos.ip, resolver.nacos.port and resolver.nacos.service must be set")
+		}
+		return c.validateCIDR()
+	case ResolverFile:
+		if c.File == "" {
+			return errors.New("resolver.file missing")
+		}
+	case ResolverTest:
+	default:
+		return fmt.Errorf("resolver.type %q invalid, want gateway, nacos, file or test", c.Type)
+	}
+	if c.AgentCIDR != "" {
+		return c.validateCIDR()
+	}
+	return nil
+}
+
+func (c *ResolverConfig) validateCIDR() error {
+	if c.AgentCIDR == "" {
+		return errors.New("resolver.agent_cidr (AGENT_CIDR) missing")
+	}
+	if _, _, err := net.ParseCIDR(c.AgentCIDR); err != nil {
+		return fmt.Errorf("resolver.agent_cidr format error: %w", err)
+	}
+	return nil
+}
+
+// Configure apply c to the common package
+func Configure(c *Config) error {
+	IdleTime = c.Idle
+	BufferSize = c.BufferSize
+	DialTimeout = c.DialTimeout
+	DcvPort = c.Ports.DCV
+	r, cache, err := newResolver(&c.Resolver)
+	if err != nil {
+		return err
+	}
+	resolver, resolverCache = r, cache
+	return SetAllowedOrigins(c.AllowedOrigins)
+}
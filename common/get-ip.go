@@ -1,69 +1,72 @@
 package common
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
-	"github.com/nacos-group/nacos-sdk-go/clients"
-	"github.com/nacos-group/nacos-sdk-go/clients/naming_client"
-	"github.com/nacos-group/nacos-sdk-go/common/constant"
-	"github.com/nacos-group/nacos-sdk-go/vo"
 	"net"
 	"net/http"
-	"net/url"
-	"os"
 	"strconv"
-)
+	"sync"
 
-var (
-	client  naming_client.INamingClient
-	iprange *net.IPNet
+	"github.com/nacos-group/nacos-sdk-go/clients"
+	"github.com/nacos-group/nacos-sdk-go/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/vo"
 )
 
 type VmInfo struct {
-	Ip string `json:"ip"`
+	Ip string `json:"ip" yaml:"ip"`
+	//ssh host key fingerprint, SHA256:... or legacy md5 hex
+	HostKey string `json:"host_key,omitempty" yaml:"host_key"`
+	//tenant scope of the token, matched by sftp policy rules
+	Scope string `json:"scope,omitempty" yaml:"scope"`
+	//vnc port of the vm, ports.vnc when not set
+	VNCPort uint16 `json:"vnc_port,omitempty" yaml:"vnc_port"`
+	//vnc credentials the proxy authenticates with, the browser is then
+	//offered no security
+	VNCUser     string `json:"vnc_user,omitempty" yaml:"vnc_user"`
+	VNCPassword string `json:"vnc_password,omitempty" yaml:"vnc_password"`
+	//vnc sessions of the token can only watch the desktop
+	VNCViewOnly bool `json:"vnc_view_only,omitempty" yaml:"vnc_view_only"`
 }
 
-func try_init() (naming_client.INamingClient, error) {
-	ip := os.Getenv("NACOS_SERVER_IP")
-	port := os.Getenv("NACOS_SERVER_PORT")
-	name := os.Getenv("NACOS_SERVER_USERNAME")
-	passwd := os.Getenv("NACOS_SERVER_PASSWORD")
-	cidr := os.Getenv("AGENT_CIDR")
+// nacosResolver asks a gateway discovered from nacos
+type nacosResolver struct {
+	config  ResolverConfig
+	iprange *net.IPNet
+	http    *http.Client
 
-	if cidr == "" {
-		return nil, errors.New("environ AGENT_CIDR missing")
-	}
-	if ip == "" {
-		ip = "127.0.0.1"
-	}
-	if port == "" {
-		port = "8848"
-	}
-	if name == "" {
-		name = "nacos"
-	}
-	if passwd == "" {
-		passwd = "nacos"
+	mu     sync.Mutex
+	client naming_client.INamingClient
+}
+
+func newNacosResolver(c *ResolverConfig) (*nacosResolver, error) {
+	if err := c.validateCIDR(); err != nil {
+		return nil, err
 	}
-	portnum, err := strconv.ParseUint(port, 10, 64)
+	iprange, err := parseCIDR(c.AgentCIDR)
 	if err != nil {
-		return nil, fmt.Errorf("port format error: %w", err)
+		return nil, err
 	}
-	_, iprange, err = net.ParseCIDR(cidr)
-	if err != nil {
-		return nil, fmt.Errorf("cidr format error: %w", err)
+	return &nacosResolver{config: *c, iprange: iprange, http: &http.Client{Timeout: c.Timeout}}, nil
+}
+
+func (r *nacosResolver) tryInit() (naming_client.INamingClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client != nil {
+		return r.client, nil
 	}
+	c := r.config
 
 	sc := []constant.ServerConfig{
-		*constant.NewServerConfig(ip, portnum),
+		*constant.NewServerConfig(c.Nacos.IP, c.Nacos.Port),
 	}
 
 	cc := constant.NewClientConfig(
-		constant.WithUsername(name),
-		constant.WithPassword(passwd),
-		constant.WithCacheDir("/var/cache/nacos"),
-		constant.WithLogDir("/var/log/nacos"),
+		constant.WithUsername(c.Nacos.Username),
+		constant.WithPassword(c.Nacos.Password),
+		constant.WithCacheDir(c.Nacos.CacheDir),
+		constant.WithLogDir(c.Nacos.LogDir),
 		//constant.WithLogLevel("debug"),
 	)
 
@@ -73,51 +76,33 @@ func try_init() (naming_client.INamingClient, error) {
 			ServerConfigs: sc,
 		},
 	)
-	return client, err
-}
-
-func Query(token string) (string, error) {
-	var err error
-	if token == "" {
-		return "", nil
+	if err != nil {
+		return nil, err
 	}
+	r.client = client
+	return client, nil
+}
 
-	if client == nil {
-		client, err = try_init()
-		if err != nil {
-			return "", err
-		}
+func (r *nacosResolver) Resolve(token string) (*VmInfo, error) {
+	client, err := r.tryInit()
+	if err != nil {
+		return nil, err
 	}
 	instance, err := client.SelectOneHealthyInstance(vo.SelectOneHealthInstanceParam{
-		ServiceName: "linyun-gateway",
+		ServiceName: r.config.Nacos.Service,
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	path := fmt.Sprintf("http://%s:%d/cm/desktop/ip_info?token=%s", instance.Ip, instance.Port, url.QueryEscape(token))
-	res, err := http.Get(path)
-	if err != nil {
-		return "", err
-	}
-	if res.StatusCode == 404 {
-		return "", nil
-	}
-	if res.StatusCode > 299 {
-		return "", errors.New(fmt.Sprintf("GET response code %d", res.StatusCode))
-	}
-	defer res.Body.Close()
-
-	var info VmInfo
-	err = json.NewDecoder(res.Body).Decode(&info)
-	if err != nil {
-		return "", err
-	}
+	host := net.JoinHostPort(instance.Ip, strconv.FormatUint(instance.Port, 10))
+	return ipInfo(r.http, host, token, r.iprange)
+}
 
-	ip := net.ParseIP(info.Ip)
-	if ip == nil || !iprange.Contains(ip) {
-		return "", errors.New("internal ip invalid")
+// Resolve token with the configured resolver
+func Resolve(token string) (*VmInfo, error) {
+	if resolver == nil {
+		return nil, errors.New("resolver not configured")
 	}
-
-	return info.Ip, nil
+	return resolver.Resolve(token)
 }
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sessionsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "webssh_sessions_active",
+		Help: "Live websocket sessions.",
+	}, []string{"protocol"})
+
+	sessionsOpened = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webssh_sessions_opened_total",
+		Help: "Websocket sessions opened.",
+	}, []string{"protocol"})
+
+	sessionsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webssh_sessions_closed_total",
+		Help: "Websocket sessions closed by reason.",
+	}, []string{"protocol", "reason"})
+
+	//reasons labelling webssh_sessions_closed_total, any other is counted as
+	//other to keep the label values bounded
+	closeReasons = map[string]bool{
+		"closed":                  true,
+		"session expired":         true,
+		"keepalive timeout":       true,
+		"server restarting":       true,
+		"killed by administrator": true,
+		"recording failed":        true,
+		"ssh connect failed":      true,
+		"detached":                true,
+		"session ended":           true,
+		"too slow":                true,
+		"attach failed":           true,
+		"resume failed":           true,
+		"exec failed":             true,
+		"exit":                    true,
+		"tunnel failed":           true,
+		"tunnel closed":           true,
+		"x11 closed":              true,
+	}
+
+	// BytesTotal counts payload bytes proxied, in is from the browser
+	BytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webssh_bytes_total",
+		Help: "Payload bytes proxied.",
+	}, []string{"protocol", "direction"})
+
+	resolveDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webssh_resolve_duration_seconds",
+		Help:    "Token resolution latency by result.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"result"})
+
+	resolveErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webssh_resolve_errors_total",
+		Help: "Token resolutions failed.",
+	})
+
+	dialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webssh_dial_failures_total",
+		Help: "Backend connections failed by the http status returned.",
+	}, []string{"protocol", "code"})
+
+	keepaliveTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webssh_keepalive_timeouts_total",
+		Help: "Websocket clients not answering pings.",
+	})
+
+	clipboardTransfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webssh_clipboard_transfers_total",
+		Help: "Clipboard texts copied through vnc and dcv sessions by action.",
+	}, []string{"protocol", "direction", "action"})
+)
+
+func observeResolve(start time.Time, info *VmInfo, err error) {
+	result := "ok"
+	switch {
+	case err != nil:
+		result = "error"
+		resolveErrors.Inc()
+	case info == nil:
+		result = "not_found"
+	}
+	resolveDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// DialFailed count a failed backend connection of protocol answered with code
+func DialFailed(protocol string, code int) {
+	dialFailures.WithLabelValues(protocol, strconv.Itoa(code)).Inc()
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPattern is an allowed origin, scheme and port are optional and the
+// host may start with "*." matching any subdomain
+type originPattern struct {
+	scheme string
+	host   string
+	port   string
+}
+
+func parseOrigin(s string) (*originPattern, error) {
+	p := &originPattern{}
+	if i := strings.Index(s, "://"); i >= 0 {
+		p.scheme, s = strings.ToLower(s[:i]), s[i+3:]
+	}
+	u, err := url.Parse("//" + strings.TrimSuffix(s, "/"))
+	if err != nil || u.Host == "" || u.Path != "" || u.User != nil {
+		return nil, fmt.Errorf("allowed origin %q format error", s)
+	}
+	p.host = strings.ToLower(u.Hostname())
+	p.port = u.Port()
+	if strings.Contains(strings.TrimPrefix(p.host, "*."), "*") {
+		return nil, fmt.Errorf("allowed origin %q: only a leading *. is supported", s)
+	}
+	return p, nil
+}
+
+func (p *originPattern) match(u *url.URL) bool {
+	if p.scheme != "" && p.scheme != strings.ToLower(u.Scheme) {
+		return false
+	}
+	if p.port != "" && p.port != originPort(u) {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if strings.HasPrefix(p.host, "*.") {
+		return strings.HasSuffix(host, p.host[1:])
+	}
+	return host == p.host
+}
+
+// originPort return the port of u, browsers leave out the default one
+func originPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// SetAllowedOrigins replace the origins allowed to open websockets, empty allows all
+func SetAllowedOrigins(origins []string) error {
+	patterns := make([]*originPattern, 0, len(origins))
+	for _, o := range origins {
+		if o == "*" {
+			patterns = nil
+			break
+		}
+		p, err := parseOrigin(o)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, p)
+	}
+	allowedOrigins = patterns
+	return nil
+}
+
+// OriginsRestricted report whether websockets are only accepted from the
+// allowed origins, rather than from any
+func OriginsRestricted() bool {
+	return len(allowedOrigins) > 0
+}
+
+// CheckOrigin report whether the Origin of r is allowed, requests without
+// Origin are not from browsers and same origin requests are always allowed
+func CheckOrigin(r *http.Request) bool {
+	if len(allowedOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, p := range allowedOrigins {
+		if p.match(u) {
+			return true
+		}
+	}
+	return false
+}
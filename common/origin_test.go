@@ -0,0 +1,88 @@
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{"allow all", nil, "https://evil.com", true},
+		{"star", []string{"*"}, "https://evil.com", true},
+		{"no origin", []string{"https://example.com"}, "", true},
+		{"same origin", []string{"https://example.com"}, "https://webssh.local:8080", true},
+		{"exact", []string{"https://example.com"}, "https://example.com", true},
+		{"other host", []string{"https://example.com"}, "https://evil.com", false},
+		{"subdomain", []string{"*.example.com"}, "https://a.example.com", true},
+		{"nested subdomain", []string{"*.example.com"}, "https://a.b.example.com", true},
+		{"subdomain parent", []string{"*.example.com"}, "https://example.com", false},
+		{"subdomain suffix", []string{"*.example.com"}, "https://evilexample.com", false},
+		{"subdomain as prefix", []string{"*.example.com"}, "https://a.example.com.evil.com", false},
+		{"no scheme http", []string{"example.com"}, "http://example.com", true},
+		{"no scheme https", []string{"example.com"}, "https://example.com", true},
+		{"scheme", []string{"https://example.com"}, "http://example.com", false},
+		{"no port", []string{"https://example.com"}, "https://example.com:8443", true},
+		{"port", []string{"https://example.com:8443"}, "https://example.com:8443", true},
+		{"other port", []string{"https://example.com:8443"}, "https://example.com", false},
+		{"default port", []string{"https://example.com:443"}, "https://example.com", true},
+		{"default port of scheme", []string{"example.com:443"}, "http://example.com", false},
+		{"uppercase pattern", []string{"HTTPS://Example.COM"}, "https://example.com", true},
+		{"uppercase origin", []string{"*.example.com"}, "HTTPS://A.EXAMPLE.COM", true},
+		{"null origin", []string{"https://example.com"}, "null", false},
+	}
+	defer SetAllowedOrigins(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetAllowedOrigins(tt.allowed); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "http://webssh.local:8080/ssh", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if ok := CheckOrigin(r); ok != tt.ok {
+				t.Fatalf("allowed %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   originPattern
+		err    bool
+	}{
+		{"https://example.com", originPattern{scheme: "https", host: "example.com"}, false},
+		{"https://example.com/", originPattern{scheme: "https", host: "example.com"}, false},
+		{"example.com:8443", originPattern{host: "example.com", port: "8443"}, false},
+		{"*.Example.com", originPattern{host: "*.example.com"}, false},
+		{"https://[::1]:8443", originPattern{scheme: "https", host: "::1", port: "8443"}, false},
+		{"https://example.com/path", originPattern{}, true},
+		{"https://user@example.com", originPattern{}, true},
+		{"a.*.example.com", originPattern{}, true},
+		{"https://", originPattern{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			p, err := parseOrigin(tt.origin)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parse %+v, want error", *p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *p != tt.want {
+				t.Fatalf("parse %+v, want %+v", *p, tt.want)
+			}
+		})
+	}
+}
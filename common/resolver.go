@@ -0,0 +1,206 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ResolverGateway = "gateway"
+	ResolverNacos   = "nacos"
+	ResolverFile    = "file"
+	ResolverTest    = "test"
+)
+
+// Resolver resolves a token to the target vm, nil info means the token is not found
+type Resolver interface {
+	Resolve(token string) (*VmInfo, error)
+}
+
+// NewResolver create the resolver selected by c.Type, wrapped by the literal ip
+// shortcut when c.Test is set and cached as c.Cache configures
+func NewResolver(c *ResolverConfig) (Resolver, error) {
+	r, _, err := newResolver(c)
+	return r, err
+}
+
+// newResolver is NewResolver returning its cache too, nil if not cached
+func newResolver(c *ResolverConfig) (Resolver, *cachingResolver, error) {
+	var r Resolver
+	var err error
+	switch c.Type {
+	case ResolverGateway, "":
+		//test mode used to work without any gateway
+		if c.Test && c.Gateway.IP == "" {
+			return &testResolver{}, nil, nil
+		}
+		r, err = newGatewayResolver(c)
+	case ResolverNacos:
+		r, err = newNacosResolver(c)
+	case ResolverFile:
+		r, err = newFileResolver(c)
+	case ResolverTest:
+		return &testResolver{}, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("resolver.type %q invalid", c.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	//only lookups reaching the backend are timed, cache hits are not
+	r = &observedResolver{next: r}
+	var cache *cachingResolver
+	if c.Cache.TTL > 0 || c.Cache.NegativeTTL > 0 {
+		cache = newCachingResolver(r, c.Cache.TTL, c.Cache.NegativeTTL)
+		r = cache
+	}
+	if c.Test {
+		r = &testResolver{next: r}
+	}
+	return r, cache, nil
+}
+
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if cidr == "" {
+		return nil, nil
+	}
+	_, iprange, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("cidr format error: %w", err)
+	}
+	return iprange, nil
+}
+
+// checkIP reject ips outside iprange, nil iprange accepts all
+func checkIP(info *VmInfo, iprange *net.IPNet) error {
+	ip := net.ParseIP(info.Ip)
+	if ip == nil || iprange != nil && !iprange.Contains(ip) {
+		return errors.New("internal ip invalid")
+	}
+	return nil
+}
+
+// ipInfo query the ip_info api of the gateway at host
+func ipInfo(client *http.Client, host, token string, iprange *net.IPNet) (*VmInfo, error) {
+	path := fmt.Sprintf("http://%s/cm/desktop/ip_info?token=%s", host, url.QueryEscape(token))
+	res, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.StatusCode > 299 {
+		return nil, errors.New(fmt.Sprintf("GET response code %d", res.StatusCode))
+	}
+
+	var info VmInfo
+	err = json.NewDecoder(res.Body).Decode(&info)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkIP(&info, iprange); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// gatewayResolver asks a fixed gateway
+type gatewayResolver struct {
+	host    string
+	iprange *net.IPNet
+	client  *http.Client
+}
+
+func newGatewayResolver(c *ResolverConfig) (*gatewayResolver, error) {
+	if c.Gateway.IP == "" {
+		return nil, errors.New("resolver gateway not configured")
+	}
+	iprange, err := parseCIDR(c.AgentCIDR)
+	if err != nil {
+		return nil, err
+	}
+	return &gatewayResolver{
+		host:    net.JoinHostPort(c.Gateway.IP, fmt.Sprint(c.Gateway.Port)),
+		iprange: iprange,
+		client:  &http.Client{Timeout: c.Timeout},
+	}, nil
+}
+
+func (r *gatewayResolver) Resolve(token string) (*VmInfo, error) {
+	return ipInfo(r.client, r.host, token, r.iprange)
+}
+
+// fileResolver looks tokens up in a static yaml map of token to vm info
+type fileResolver struct {
+	targets map[string]*VmInfo
+}
+
+func newFileResolver(c *ResolverConfig) (*fileResolver, error) {
+	data, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("read resolver file: %w", err)
+	}
+	r := &fileResolver{}
+	if err = yaml.UnmarshalStrict(data, &r.targets); err != nil {
+		return nil, fmt.Errorf("decode resolver file: %w", err)
+	}
+	iprange, err := parseCIDR(c.AgentCIDR)
+	if err != nil {
+		return nil, err
+	}
+	for token, info := range r.targets {
+		if info == nil {
+			return nil, fmt.Errorf("resolver file: token %s has no target", token)
+		}
+		if err = checkIP(info, iprange); err != nil {
+			return nil, fmt.Errorf("resolver file: token %s: %w", token, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *fileResolver) Resolve(token string) (*VmInfo, error) {
+	info, ok := r.targets[token]
+	if !ok {
+		return nil, nil
+	}
+	target := *info
+	return &target, nil
+}
+
+// testResolver use literal ip tokens directly, asking next for other tokens
+type testResolver struct {
+	next Resolver
+}
+
+func (r *testResolver) Resolve(token string) (*VmInfo, error) {
+	if ip := net.ParseIP(token); ip != nil {
+		return &VmInfo{Ip: token}, nil
+	}
+	if r.next == nil {
+		return nil, nil
+	}
+	return r.next.Resolve(token)
+}
+
+// observedResolver record the latency and result of the lookups of next
+type observedResolver struct {
+	next Resolver
+}
+
+func (r *observedResolver) Resolve(token string) (*VmInfo, error) {
+	start := time.Now()
+	info, err := r.next.Resolve(token)
+	observeResolve(start, info, err)
+	return info, err
+}
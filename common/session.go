@@ -0,0 +1,369 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Session is a live websocket session proxied to a target vm
+type Session struct {
+	//accessed atomically, kept first for alignment
+	bytesIn   int64
+	bytesOut  int64
+	lastInput int64
+
+	ID    string
+	Kind  string
+	Token string
+	//target vm ip
+	Target string
+	Remote string
+	Start  time.Time
+	//login user, set once authenticated
+	user string
+	//id others join the session with
+	share string
+
+	in   prometheus.Counter
+	out  prometheus.Counter
+	conn *websocket.Conn
+	//stops a session served without websocket
+	cancel func()
+	once   sync.Once
+	//why the server closed the session, first one wins
+	reason string
+	//the server asked the client to close
+	shutdown bool
+	//the websocket is lost, the session waits to be resumed
+	detached bool
+}
+
+// TokenHash identify token in logs and file names without disclosing it, as
+// the token itself grants access
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewSessionID return a random session id, safe in url paths and file names
+func NewSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		//an id only has to be unique
+		binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Close ask the client to close the session with reason, a session without
+// websocket or detached from it is stopped at once
+func (s *Session) Close(reason string) error {
+	sessions.mu.Lock()
+	stop := s.conn == nil || s.detached
+	//a detached session ends for reason rather than for having been detached
+	if stop && (s.reason == "" || s.detached) {
+		s.reason = reason
+	}
+	cancel := s.cancel
+	sessions.mu.Unlock()
+	if !stop {
+		return Shutdown(s.conn, reason)
+	}
+	cancel()
+	return nil
+}
+
+// Detach mark the session as lost by its websocket, cancel ends it
+func (s *Session) Detach(cancel func()) {
+	sessions.mu.Lock()
+	s.detached = true
+	s.cancel = cancel
+	sessions.mu.Unlock()
+}
+
+// Kill close the session with reason, dropping the connection if the client
+// does not close it in time
+func (s *Session) Kill(reason string) {
+	s.Close(reason)
+	sessions.mu.Lock()
+	stopped := s.conn == nil || s.detached
+	sessions.mu.Unlock()
+	if stopped {
+		return
+	}
+	time.AfterFunc(killGrace, func() {
+		s.conn.Close()
+	})
+}
+
+// SetUser set the login user
+func (s *Session) SetUser(user string) {
+	sessions.mu.Lock()
+	s.user = user
+	sessions.mu.Unlock()
+}
+
+// SetShare set the id others join the session with
+func (s *Session) SetShare(share string) {
+	sessions.mu.Lock()
+	s.share = share
+	sessions.mu.Unlock()
+}
+
+// Input count n bytes of user input received from the browser
+func (s *Session) Input(n int) {
+	s.Received(n)
+	s.Touch()
+}
+
+// Received count n bytes received from the browser, user input or not
+func (s *Session) Received(n int) {
+	atomic.AddInt64(&s.bytesIn, int64(n))
+	s.in.Add(float64(n))
+}
+
+// Touch set the last input time of the session to now
+func (s *Session) Touch() {
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+}
+
+// Output count n bytes sent to the browser
+func (s *Session) Output(n int) {
+	atomic.AddInt64(&s.bytesOut, int64(n))
+	s.out.Add(float64(n))
+}
+
+// SessionInfo is a snapshot of a live session, without the token as it grants access
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	User      string    `json:"user,omitempty"`
+	Share     string    `json:"share,omitempty"`
+	TokenHash string    `json:"token_sha256"`
+	Target    string    `json:"target"`
+	Remote    string    `json:"remote"`
+	Start     time.Time `json:"start"`
+	LastInput time.Time `json:"last_input"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	//waiting to be resumed
+	Detached bool `json:"detached,omitempty"`
+}
+
+// Info snapshot the session
+func (s *Session) Info() *SessionInfo {
+	sessions.mu.Lock()
+	user, share, detached := s.user, s.share, s.detached
+	sessions.mu.Unlock()
+	return &SessionInfo{
+		ID:        s.ID,
+		Kind:      s.Kind,
+		User:      user,
+		Share:     share,
+		TokenHash: TokenHash(s.Token),
+		Target:    s.Target,
+		Remote:    s.Remote,
+		Start:     s.Start,
+		LastInput: time.Unix(0, atomic.LoadInt64(&s.lastInput)),
+		BytesIn:   atomic.LoadInt64(&s.bytesIn),
+		BytesOut:  atomic.LoadInt64(&s.bytesOut),
+		Detached:  detached,
+	}
+}
+
+// Done remove the session from the registry, called once the session has ended
+func (s *Session) Done() {
+	s.once.Do(func() {
+		sessions.remove(s)
+	})
+}
+
+// closing record reason on the session of conn
+func closing(conn *websocket.Conn, reason string) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	if s, ok := sessions.sessions[conn]; ok && s.reason == "" {
+		s.reason = reason
+	}
+}
+
+// shutdown record that the server asked the client of conn to close with reason
+func shutdown(conn *websocket.Conn, reason string) {
+	closing(conn, reason)
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	if s, ok := sessions.sessions[conn]; ok {
+		s.shutdown = true
+	}
+}
+
+// ClosedByServer report whether the server asked the client of conn to close,
+// so that a connection lost afterwards has not been lost by the network
+func ClosedByServer(conn *websocket.Conn) bool {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	s, ok := sessions.sessions[conn]
+	return ok && s.shutdown
+}
+
+type registry struct {
+	mu       sync.Mutex
+	sessions map[*websocket.Conn]*Session
+	//sessions served without websocket
+	requests map[*Session]struct{}
+	draining bool
+	//closed when the last session is done while draining
+	empty chan struct{}
+}
+
+var sessions = &registry{
+	sessions: make(map[*websocket.Conn]*Session),
+	requests: make(map[*Session]struct{}),
+	empty:    make(chan struct{}),
+}
+
+func (r *registry) len() int {
+	return len(r.sessions) + len(r.requests)
+}
+
+func (r *registry) remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.conn != nil {
+		delete(r.sessions, s.conn)
+	} else {
+		delete(r.requests, s)
+	}
+	reason := s.reason
+	if reason == "" {
+		reason = "closed"
+	} else if !closeReasons[reason] {
+		reason = "other"
+	}
+	sessionsActive.WithLabelValues(s.Kind).Dec()
+	sessionsClosed.WithLabelValues(s.Kind, reason).Inc()
+	if r.draining && r.len() == 0 {
+		close(r.empty)
+	}
+}
+
+// Register track the session of conn, nil is returned while draining and the
+// client has been asked to come back later
+func Register(kind, id, token string, target net.Addr, conn *websocket.Conn) *Session {
+	s := newSession(kind, id, token, target, conn.RemoteAddr().String())
+	s.conn = conn
+
+	sessions.mu.Lock()
+	draining := sessions.draining
+	if !draining {
+		sessions.sessions[conn] = s
+	}
+	sessions.mu.Unlock()
+	if draining {
+		Shutdown(conn, "server restarting")
+		conn.Close()
+		return nil
+	}
+	sessionsOpened.WithLabelValues(kind).Inc()
+	sessionsActive.WithLabelValues(kind).Inc()
+	return s
+}
+
+// RegisterRequest track a session served over the http request of remote,
+// stopped by cancel when killed or drained. nil is returned while draining
+func RegisterRequest(kind, id, token string, target net.Addr, remote string, cancel func()) *Session {
+	s := newSession(kind, id, token, target, remote)
+	s.cancel = cancel
+
+	sessions.mu.Lock()
+	draining := sessions.draining
+	if !draining {
+		sessions.requests[s] = struct{}{}
+	}
+	sessions.mu.Unlock()
+	if draining {
+		return nil
+	}
+	sessionsOpened.WithLabelValues(kind).Inc()
+	sessionsActive.WithLabelValues(kind).Inc()
+	return s
+}
+
+func newSession(kind, id, token string, target net.Addr, remote string) *Session {
+	host, _, err := net.SplitHostPort(target.String())
+	if err != nil {
+		host = target.String()
+	}
+	s := &Session{
+		ID:     id,
+		Kind:   kind,
+		Token:  token,
+		Target: host,
+		Remote: remote,
+		Start:  time.Now(),
+		in:     BytesTotal.WithLabelValues(kind, "in"),
+		out:    BytesTotal.WithLabelValues(kind, "out"),
+	}
+	s.lastInput = s.Start.UnixNano()
+	return s
+}
+
+// Sessions list the live sessions
+func Sessions() []*Session {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	list := make([]*Session, 0, sessions.len())
+	for _, s := range sessions.sessions {
+		list = append(list, s)
+	}
+	for s := range sessions.requests {
+		list = append(list, s)
+	}
+	return list
+}
+
+// Drain refuse new sessions and ask the live ones to close, then wait for them
+// to end until ctx is done, when the remaining connections are closed
+func Drain(ctx context.Context) int {
+	sessions.mu.Lock()
+	if !sessions.draining {
+		sessions.draining = true
+		if sessions.len() == 0 {
+			close(sessions.empty)
+		}
+	}
+	sessions.mu.Unlock()
+
+	for _, s := range Sessions() {
+		//requests are let finish until ctx is done, detached sessions
+		//can not be resumed any more and are stopped
+		if s.conn != nil {
+			s.Close("server restarting")
+		}
+	}
+
+	select {
+	case <-sessions.empty:
+		return 0
+	case <-ctx.Done():
+	}
+	remaining := Sessions()
+	for _, s := range remaining {
+		if s.conn != nil {
+			s.conn.Close()
+		} else {
+			s.Close("server restarting")
+		}
+	}
+	return len(remaining)
+}
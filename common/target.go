@@ -1,83 +1,69 @@
 package common
 
 import (
-	"encoding/json"
-	"errors"
-	"fmt"
+	"log"
 	"net"
 	"net/http"
-	"net/url"
-	"os"
 	"strconv"
 )
 
-func query(token string) (string, error) {
-	s := os.Getenv("SERVER_IP")
-	p := os.Getenv("SERVER_PORT")
-	cidr := os.Getenv("AGENT_CIDR")
-
-	//if set, use token as ip directly, used for test only
-	if _, test := os.LookupEnv("WEBSSH_TEST"); test {
-		if ip := net.ParseIP(token); ip != nil {
-			return token, nil
-		}
-	}
-
-	if s == "" || p == "" || cidr == "" {
-		return "", errors.New("environ missing")
-	}
-	ip := net.ParseIP(s)
-	if ip == nil {
-		return "", fmt.Errorf("ip format error")
-	}
-	portnum, err := strconv.ParseUint(p, 10, 64)
+// GetTarget resolve token to the target vm info
+func GetTarget(token string) (*VmInfo, error, int) {
+	info, err := Resolve(token)
 	if err != nil {
-		return "", fmt.Errorf("port format error: %w", err)
+		return nil, err, http.StatusInternalServerError
 	}
-	_, iprange, err = net.ParseCIDR(cidr)
-	if err != nil {
-		return "", fmt.Errorf("cidr format error: %w", err)
+	if info == nil {
+		return nil, nil, http.StatusNotFound
 	}
+	return info, nil, 0
+}
 
-	path := fmt.Sprintf("http://%s:%d/cm/desktop/ip_info?token=%s", s, portnum, url.QueryEscape(token))
-	res, err := http.Get(path)
+// DialTarget connect to port of the target vm
+func DialTarget(info *VmInfo, port uint16) (net.Conn, error, int) {
+	conn, err := net.DialTimeout("tcp", info.Ip+":"+strconv.Itoa(int(port)), DialTimeout)
 	if err != nil {
-		return "", err
-	}
-	if res.StatusCode == 404 {
-		return "", nil
-	}
-	if res.StatusCode > 299 {
-		return "", errors.New(fmt.Sprintf("GET response code %d", res.StatusCode))
+		return nil, err, http.StatusServiceUnavailable
 	}
-	defer res.Body.Close()
+	return conn, nil, 0
+}
 
-	var info VmInfo
-	err = json.NewDecoder(res.Body).Decode(&info)
-	if err != nil {
-		return "", err
+// GetTargetConn resolve token and connect to the port of its vm chosen by port
+func GetTargetConn(token string, port func(*VmInfo) uint16) (net.Conn, *VmInfo, error, int) {
+	info, err, code := GetTarget(token)
+	if info == nil {
+		return nil, nil, err, code
 	}
-
-	ipstr := net.ParseIP(info.Ip)
-	if ipstr == nil || !iprange.Contains(ipstr) {
-		return "", errors.New("internal ip invalid")
+	conn, err, code := DialTarget(info, port(info))
+	if conn == nil {
+		//the vm may have moved, look it up again next time
+		Invalidate(token)
+		return nil, info, err, code
 	}
+	return conn, info, nil, 0
+}
 
-	return info.Ip, nil
+// Port choose the same port for every vm
+func Port(port uint16) func(*VmInfo) uint16 {
+	return func(*VmInfo) uint16 { return port }
 }
 
-func GetTargetConn(token string, port uint16) (net.Conn, error, int) {
-	ip, err := query(token)
-	if err != nil {
-		return nil, err, http.StatusInternalServerError
+// ConnectTarget is GetTargetConn answering w with the failure and counting it
+// for protocol, conn is nil once w is answered with status
+func ConnectTarget(w http.ResponseWriter, logger *log.Logger, protocol, token string, port func(*VmInfo) uint16) (net.Conn, *VmInfo, int) {
+	conn, info, err, code := GetTargetConn(token, port)
+	if conn != nil {
+		return conn, info, 0
 	}
-	if ip == "" {
-		return nil, nil, http.StatusNotFound
+	logger.Printf("%s get target connection failed with %d(%s)", protocol, code, err)
+	if code == 0 {
+		code = http.StatusInternalServerError
 	}
-
-	conn, err := net.Dial("tcp", ip+":"+strconv.Itoa(int(port)))
+	DialFailed(protocol, code)
 	if err != nil {
-		return nil, err, http.StatusServiceUnavailable
+		http.Error(w, err.Error(), code)
+	} else {
+		w.WriteHeader(code)
 	}
-	return conn, nil, 0
+	return nil, info, code
 }
@@ -0,0 +1,164 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// CertReloader serves the certificate and client ca bundle from files,
+// reloading them whenever the files change
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+
+	watcher *fsnotify.Watcher
+}
+
+func NewCertReloader(certFile, keyFile, caFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("watch certificate: %w", err)
+	}
+	//watch the dirs, certificates are usually replaced by renaming
+	dirs := map[string]bool{}
+	for _, f := range []string{certFile, keyFile, caFile} {
+		if f != "" {
+			dirs[filepath.Dir(f)] = true
+		}
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("watch certificate: %w", err)
+		}
+	}
+	r.watcher = watcher
+	go r.watch()
+	return r, nil
+}
+
+func (r *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("load client ca: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("load client ca: no certificate found")
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) watch() {
+	for {
+		select {
+		case e, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if !r.watched(e.Name) || e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			//keep serving the previous certificate when the new one is incomplete
+			if err := r.load(); err != nil {
+				log.Printf("tls reload failed %s", err)
+			} else {
+				log.Printf("tls reloaded %s", e.Name)
+			}
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("tls watch failed %s", err)
+		}
+	}
+}
+
+func (r *CertReloader) watched(name string) bool {
+	name = filepath.Clean(name)
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f != "" && filepath.Clean(f) == name {
+			return true
+		}
+	}
+	//kubernetes secrets swap the ..data symlink
+	return filepath.Base(name) == "..data"
+}
+
+// TLSConfig returns a config picking up reloaded certificates on every handshake
+func (r *CertReloader) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				c.ClientCAs = r.clientCAs
+				c.ClientAuth = clientAuth
+			}
+			return c, nil
+		},
+	}
+}
+
+func (r *CertReloader) Close() error {
+	return r.watcher.Close()
+}
+
+// RedirectHandler redirects plain http requests to https on port
+func RedirectHandler(port uint16) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
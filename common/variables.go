@@ -1,8 +1,27 @@
 package common
 
+import "time"
+
 var (
 	BufferSize = 4096
 
 	//when IdleTime Minutes reached without any user input, force disconnect
 	IdleTime = 30
+
+	//timeout connecting to the target vm
+	DialTimeout = 10 * time.Second
+
+	//dcv server port on the target vm
+	DcvPort uint16 = 8443
+
+	//resolves tokens to target vms
+	resolver Resolver
+	//cache of resolver, nil if not cached
+	resolverCache *cachingResolver
+
+	//time a killed session is given to close before its connection is dropped
+	killGrace = 3 * time.Second
+
+	//origins allowed to open websockets, empty allows all
+	allowedOrigins []*originPattern
 )
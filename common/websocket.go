@@ -3,9 +3,11 @@ package common
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,9 +16,7 @@ import (
 func Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
 	upgrader := websocket.Upgrader{
 		// cross origin domain
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin:     CheckOrigin,
 		ReadBufferSize:  BufferSize,
 		WriteBufferSize: BufferSize,
 	}
@@ -29,7 +29,9 @@ func KeepAlive(conn *websocket.Conn, ch chan struct{}, logger *log.Logger) bool
 	defer tick.Stop()
 
 	//disable tcp keepalive, use websocket ping/pong instead
-	conn.UnderlyingConn().(*net.TCPConn).SetKeepAlive(false)
+	if tcp, ok := conn.UnderlyingConn().(*net.TCPConn); ok {
+		tcp.SetKeepAlive(false)
+	}
 	conn.SetPongHandler(func(m string) error { ch <- struct{}{}; return nil })
 
 	for {
@@ -49,6 +51,8 @@ func KeepAlive(conn *websocket.Conn, ch chan struct{}, logger *log.Logger) bool
 			cnt++
 			if cnt > 3 {
 				logger.Printf("websocket client not responding")
+				keepaliveTimeouts.Inc()
+				closing(conn, "keepalive timeout")
 				return false
 			}
 		}
@@ -73,6 +77,7 @@ func ReadMessageWithIdleTime(conn *websocket.Conn, logger *log.Logger) (int, []b
 }
 
 func Shutdown(conn *websocket.Conn, msg string) error {
+	shutdown(conn, msg)
 	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, msg)
 
 	err := conn.WriteControl(websocket.CloseMessage, message, time.Time{})
@@ -83,15 +88,19 @@ func Shutdown(conn *websocket.Conn, msg string) error {
 }
 
 func Client(token, path string, r *http.Request) (*websocket.Conn, *http.Response, error) {
-	ip, err := query(token)
+	info, err := Resolve(token)
 	if err != nil {
 		return nil, nil, err
 	}
+	if info == nil {
+		return nil, nil, errors.New("token not found")
+	}
+	ip := info.Ip
 
 	if r.Header.Get("Upgrade") == "" {
 		req, _ := http.NewRequest(http.MethodGet, "*", nil)
 		req.URL.Scheme = "https"
-		req.URL.Host = ip + ":8443"
+		req.URL.Host = ip + ":" + strconv.Itoa(int(DcvPort))
 		req.URL.Path = "/" + path
 		req.URL.ForceQuery = r.URL.ForceQuery
 		req.URL.RawQuery = r.URL.RawQuery
@@ -107,6 +116,10 @@ func Client(token, path string, r *http.Request) (*websocket.Conn, *http.Respons
 
 		//rsp, err := http.DefaultClient.Do(req)
 		rsp, err := client.Do(req)
+		if err != nil {
+			//the vm may have moved, look it up again next time
+			Invalidate(token)
+		}
 		return nil, rsp, err
 	}
 
@@ -130,6 +143,11 @@ func Client(token, path string, r *http.Request) (*websocket.Conn, *http.Respons
 		reqHeader.Del(h)
 	}
 	//TODO: dcvserver requests https, we may pass through when certificates are ready
-	reqHeader.Set("Origin", "https://"+ip+":8443")
-	return d.Dial("wss://"+ip+":8443/"+path, reqHeader)
+	host := ip + ":" + strconv.Itoa(int(DcvPort))
+	reqHeader.Set("Origin", "https://"+host)
+	conn, rsp, err := d.Dial("wss://"+host+"/"+path, reqHeader)
+	if err != nil && rsp == nil {
+		Invalidate(token)
+	}
+	return conn, rsp, err
 }
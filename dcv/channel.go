@@ -0,0 +1,25 @@
+package dcv
+
+import (
+	"path"
+	"strings"
+)
+
+// name of the channel carrying the keyboard and mouse events
+const InputChannel = "input"
+
+// IsChannel report whether the websocket path p of a dcv session is the
+// channel named name, ok is false when the last element of p is not plain
+// enough to tell
+func IsChannel(p, name string) (is, ok bool) {
+	channel := path.Base(path.Clean("/" + p))
+	if channel == "/" {
+		return false, true
+	}
+	for _, r := range channel {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false, false
+		}
+	}
+	return strings.EqualFold(channel, name), true
+}
@@ -7,7 +7,33 @@ import (
 	"github.com/myml/webssh/common"
 )
 
-func Proxy(logger *log.Logger, src *websocket.Conn, dst *websocket.Conn) {
+// Hook of the messages relayed, upload for the ones of the browser, return
+// the message to relay and false to drop it
+type Hook func(upload bool, msgType int, msg []byte) ([]byte, bool)
+
+// ClipboardHook apply the deny policy to the messages of the clipboard
+// channel. The messages are opaque frames, which max length and log hash
+// can not be applied to
+func ClipboardHook(logger *log.Logger, c *common.ClipboardConfig) Hook {
+	deny := &common.ClipboardConfig{
+		Upload:   common.ClipboardRule{Policy: c.Upload.Policy},
+		Download: common.ClipboardRule{Policy: c.Download.Policy},
+	}
+	return func(upload bool, msgType int, msg []byte) ([]byte, bool) {
+		dir := common.ClipboardDownload
+		if upload {
+			dir = common.ClipboardUpload
+		}
+		if deny.Rule(dir).Policy != common.ClipboardDeny {
+			return msg, true
+		}
+		return deny.Apply(logger, "dcv", dir, msg, false)
+	}
+}
+
+// Proxy relay the messages of the browser src and the dcv server dst, the ones
+// of the browser set the last input time of s when input is true
+func Proxy(logger *log.Logger, src *websocket.Conn, dst *websocket.Conn, s *common.Session, input bool, hook Hook) {
 	logger.Printf("dcv start working %s->%s", src.RemoteAddr().String(), dst.RemoteAddr().String())
 
 	ch := make(chan struct{}, 1)
@@ -26,6 +52,13 @@ func Proxy(logger *log.Logger, src *websocket.Conn, dst *websocket.Conn) {
 				logger.Printf("dst websocket read failed %s", err.Error())
 				return
 			}
+			s.Output(len(msg))
+			if hook != nil {
+				var ok bool
+				if msg, ok = hook(false, msgType, msg); !ok {
+					continue
+				}
+			}
 			src.WriteMessage(msgType, msg)
 		}
 	}()
@@ -38,6 +71,16 @@ func Proxy(logger *log.Logger, src *websocket.Conn, dst *websocket.Conn) {
 			logger.Printf("src websocket read failed %s", err.Error())
 			return
 		}
+		s.Received(len(msg))
+		if input {
+			s.Touch()
+		}
+		if hook != nil {
+			var ok bool
+			if msg, ok = hook(true, msgType, msg); !ok {
+				continue
+			}
+		}
 		err = dst.WriteMessage(msgType, msg)
 		if err != nil {
 			logger.Printf("dst websocket write failed %s", err.Error())
@@ -8,8 +8,6 @@ term.open(document.getElementById("main"));
 
 const ws = new WebSocket(`ws://${location.host}/api/ssh?token=127.0.0.1:22&user=zhangsan`);
 ws.onopen = () => {
-  ws.send(JSON.stringify({ type: "login", data: utoa(user) }));
-  ws.send(JSON.stringify({ type: "password", data: utoa(password) }));
   term.on("data", data => {
     const msg = { type: "stdin", data: btoa(data) };
     ws.send(JSON.stringify(msg));
@@ -27,6 +25,19 @@ ws.onmessage = e => {
     case "stdout":
     case "stderr":
       term.write(atou(msg.data));
+      break;
+    case "login":
+      ws.send(JSON.stringify({ type: "login", data: utoa(user) }));
+      break;
+    case "password":
+      ws.send(JSON.stringify({ type: "password", data: utoa(password || prompt(atou(msg.data))) }));
+      break;
+    case "challenge":
+      const answers = msg.questions.map(q => prompt(q));
+      ws.send(JSON.stringify({ type: "challenge", answers }));
+      break;
+    case "publickey":
+      ws.send(JSON.stringify({ type: "publickey", data: "" }));
   }
 };
 ws.onerror = console.error;
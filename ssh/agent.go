@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	agentChannelType = "auth-agent@openssh.com"
+	//agent messages are small, keys and signatures included
+	maxAgentMessage = 256 * 1024
+	//SSH_AGENT_FAILURE
+	agentFailure = 5
+)
+
+// time waited for the browser agent to answer a request
+var AgentTimeout = 30 * time.Second
+
+// SetAgentForwarding forward the ssh agent of the browser to the shell
+func (ws *WebSSH) SetAgentForwarding(forward bool) *WebSSH {
+	ws.agent = forward
+	return ws
+}
+
+// forwardAgent ask the server to forward agent connections of s to the browser
+func (ws *WebSSH) forwardAgent(s *ssh.Session) error {
+	chans := ws.conn.HandleChannelOpen(agentChannelType)
+	if chans == nil {
+		return errors.New("agent channel already handled")
+	}
+	go func() {
+		for nc := range chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				ws.logger.Printf("agent channel accept failed %s", err)
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go ws.serveAgent(ch)
+		}
+	}()
+	ws.agentReplies = make(chan []byte, 1)
+	return errors.Wrap(agent.RequestAgentForwarding(s), "agent forwarding")
+}
+
+// serveAgent relay the requests of an agent connection to the browser
+func (ws *WebSSH) serveAgent(ch ssh.Channel) {
+	defer ch.Close()
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(ch, length[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n == 0 || n > maxAgentMessage {
+			ws.logger.Printf("agent request of %d bytes rejected", n)
+			return
+		}
+		req := make([]byte, n)
+		if _, err := io.ReadFull(ch, req); err != nil {
+			return
+		}
+		reply := ws.agentRequest(req)
+		binary.BigEndian.PutUint32(length[:], uint32(len(reply)))
+		if _, err := ch.Write(append(length[:], reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// agentRequest send req to the browser and wait for its reply, requests of
+// all agent connections are answered one at a time
+func (ws *WebSSH) agentRequest(req []byte) []byte {
+	ws.amu.Lock()
+	defer ws.amu.Unlock()
+	//drop a reply arriving after its request timed out
+	select {
+	case <-ws.agentReplies:
+	default:
+	}
+	if err := ws.writeJSON(&message{Type: messageTypeAgent, Data: req}); err != nil {
+		return []byte{agentFailure}
+	}
+	timer := time.NewTimer(AgentTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-ws.agentReplies:
+		if len(reply) == 0 || len(reply) > maxAgentMessage {
+			return []byte{agentFailure}
+		}
+		return reply
+	case <-timer.C:
+		ws.logger.Printf("agent request timed out")
+		return []byte{agentFailure}
+	}
+}
+
+// agentReply hand the reply of the browser to the pending request
+func (ws *WebSSH) agentReply(reply []byte) {
+	if ws.agentReplies == nil {
+		return
+	}
+	select {
+	case ws.agentReplies <- reply:
+	default:
+	}
+}
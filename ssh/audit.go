@@ -0,0 +1,132 @@
+package ssh
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// operations changing the remote file system, audited along with opens and closes
+var auditedOps = map[string]bool{
+	"open":     true,
+	"close":    true,
+	"setstat":  true,
+	"fsetstat": true,
+	"remove":   true,
+	"mkdir":    true,
+	"rmdir":    true,
+	"rename":   true,
+	"symlink":  true,
+	"hardlink": true,
+}
+
+var sftpResults = map[uint32]string{
+	sshFxOk:               "ok",
+	sshFxEOF:              "eof",
+	sshFxNoSuchFile:       "no such file",
+	sshFxPermissionDenied: "permission denied",
+	sshFxFailure:          "failure",
+	sshFxBadMessage:       "bad message",
+	sshFxNoConnection:     "no connection",
+	sshFxConnectionLost:   "connection lost",
+	sshFxOpUnsupported:    "unsupported",
+}
+
+// SftpEvent is one line of the sftp audit log
+type SftpEvent struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	//first 8 bytes of the sha256 of the token, the token itself grants access
+	Token  string `json:"token_sha256"`
+	User   string `json:"user"`
+	Target string `json:"target"`
+	Op     string `json:"op"`
+	Path   string `json:"path,omitempty"`
+	//new path of rename, file linked to by symlink and hardlink
+	NewPath string `json:"new_path,omitempty"`
+	//open mode: read, write or read-write
+	Mode         string `json:"mode,omitempty"`
+	BytesRead    uint64 `json:"bytes_read,omitempty"`
+	BytesWritten uint64 `json:"bytes_written,omitempty"`
+	//denied by policy rather than by the server
+	Denied bool   `json:"denied,omitempty"`
+	Code   uint32 `json:"code"`
+	Result string `json:"result"`
+}
+
+// SftpAudit writes sftp events as json lines
+type SftpAudit struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// NewSftpAudit append events to file, "-" for stdout
+func NewSftpAudit(file string) (*SftpAudit, error) {
+	var w io.WriteCloser = os.Stdout
+	if file != "-" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "open sftp audit")
+		}
+		w = f
+	}
+	return &SftpAudit{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (a *SftpAudit) Write(e *SftpEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enc.Encode(e)
+}
+
+func (a *SftpAudit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
+
+func openMode(flags uint32) string {
+	read := flags&sshFxfRead != 0
+	write := flags&(sshFxfWrite|sshFxfAppend|sshFxfCreat|sshFxfTrunc) != 0
+	switch {
+	case read && write:
+		return "read-write"
+	case write:
+		return "write"
+	case read:
+		return "read"
+	}
+	return ""
+}
+
+// record audit the result of req, h is the handle being closed
+func (f *sftpFilter) record(req *sftpRequest, h *sftpHandle, code uint32, denied bool) {
+	if f.audit == nil || !denied && !auditedOps[req.Op] {
+		return
+	}
+	//directory handles are listed, not transferred
+	if !denied && h != nil && h.dir {
+		return
+	}
+
+	e := f.event
+	e.Time = time.Now()
+	e.Op = req.Op
+	e.Path = req.Path
+	e.NewPath = req.Target
+	e.Mode = openMode(req.Flags)
+	e.Denied = denied
+	e.Code = code
+	e.Result = sftpResults[code]
+	if h != nil {
+		e.Mode = openMode(h.flags)
+		e.BytesRead = h.read
+		e.BytesWritten = h.written
+	}
+	f.audit.Write(&e)
+}
@@ -0,0 +1,155 @@
+package ssh
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/myml/webssh/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxAuthTries limits the credentials sent in all, below the MaxAuthTries of 6
+// of openssh servers, which disconnect without telling why
+const maxAuthTries = 5
+
+// maxPasswordTries limits the passwords asked before moving on, leaving tries
+// to keyboard-interactive
+const maxPasswordTries = 3
+
+// AuthMethods returns auth methods asking the browser for credentials
+// over the websocket, tried as publickey, password then keyboard-interactive
+func (ws *WebSSH) AuthMethods() []ssh.AuthMethod {
+	passwordTries := maxPasswordTries
+	if ws.emptyPassword {
+		passwordTries++
+	}
+	return []ssh.AuthMethod{
+		ssh.PublicKeysCallback(ws.publicKeys),
+		ssh.RetryableAuthMethod(ssh.PasswordCallback(ws.password()), passwordTries),
+		ssh.RetryableAuthMethod(ssh.KeyboardInteractive(ws.challenge), maxAuthTries),
+	}
+}
+
+// SetEmptyPassword try an empty password before asking the browser for one,
+// the failure shows in the auth log of the server
+func (ws *WebSSH) SetEmptyPassword(empty bool) *WebSSH {
+	ws.emptyPassword = empty
+	return ws
+}
+
+// attempt count a credential about to be sent, failing once all are spent
+func (ws *WebSSH) attempt() error {
+	ws.authTries++
+	if ws.authTries > maxAuthTries {
+		return errors.New("too many authentication failures")
+	}
+	return nil
+}
+
+// prompt send req to the browser and wait for the reply of the same type
+func (ws *WebSSH) prompt(req *message) (*message, error) {
+	if err := ws.writeJSON(req); err != nil {
+		return nil, errors.Wrap(err, "websocket write")
+	}
+	for {
+		msgType, data, err := common.ReadMessageWithIdleTime(ws.websocket, ws.logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "websocket read")
+		}
+		if msgType != websocket.TextMessage {
+			continue
+		}
+
+		var msg message
+		if err = json.Unmarshal(data, &msg); err != nil {
+			return nil, errors.Wrap(err, "json unmarshal")
+		}
+		switch msg.Type {
+		case req.Type:
+			return &msg, nil
+		case messageTypeResize:
+			//remember terminal size for the pty request
+			ws.rows, ws.cols = msg.Rows, msg.Cols
+		}
+	}
+}
+
+func (ws *WebSSH) login() (string, error) {
+	msg, err := ws.prompt(&message{Type: messageTypeLogin})
+	if err != nil {
+		return "", errors.Wrap(err, "login")
+	}
+	return string(msg.Data), nil
+}
+
+func (ws *WebSSH) password() func() (string, error) {
+	tries := 0
+	return func() (string, error) {
+		if err := ws.attempt(); err != nil {
+			return "", err
+		}
+		tries++
+		//the empty password accepted by legacy VMs is tried first when asked
+		if tries == 1 && ws.emptyPassword {
+			return "", nil
+		}
+		msg, err := ws.prompt(&message{Type: messageTypePassword, Data: []byte("Password: ")})
+		if err != nil {
+			return "", errors.Wrap(err, "password")
+		}
+		return string(msg.Data), nil
+	}
+}
+
+func (ws *WebSSH) challenge(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	//servers may send an empty info request, answer it without bothering the user
+	if len(questions) == 0 {
+		return []string{}, nil
+	}
+	if err := ws.attempt(); err != nil {
+		return nil, err
+	}
+	msg, err := ws.prompt(&message{
+		Type:        messageTypeChallenge,
+		Data:        []byte(user),
+		Instruction: instruction,
+		Questions:   questions,
+		Echos:       echos,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "challenge")
+	}
+	if len(msg.Answers) != len(questions) {
+		return nil, errors.Errorf("challenge expects %d answers, got %d", len(questions), len(msg.Answers))
+	}
+	return msg.Answers, nil
+}
+
+func (ws *WebSSH) publicKeys() ([]ssh.Signer, error) {
+	msg, err := ws.prompt(&message{Type: messageTypePublickey})
+	if err != nil {
+		return nil, errors.Wrap(err, "publickey")
+	}
+	//browser has no key to offer
+	if len(msg.Data) == 0 {
+		return nil, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(msg.Data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		var pass *message
+		pass, err = ws.prompt(&message{Type: messageTypePassword, Data: []byte("Enter passphrase for key: ")})
+		if err != nil {
+			return nil, errors.Wrap(err, "passphrase")
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(msg.Data, pass.Data)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key")
+	}
+	if err = ws.attempt(); err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{signer}, nil
+}
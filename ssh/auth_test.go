@@ -0,0 +1,149 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// browser answer the prompts of a session over conn, with password to every
+// password prompt and code to every challenge, returning the prompts seen
+func browser(conn *websocket.Conn, password, code string) []string {
+	var prompts []string
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return prompts
+		}
+		prompts = append(prompts, string(msg.Type))
+		reply := &message{Type: msg.Type}
+		switch msg.Type {
+		case messageTypePassword:
+			reply.Data = []byte(password)
+		case messageTypeChallenge:
+			reply.Answers = []string{code}
+		}
+		conn.WriteJSON(reply)
+	}
+}
+
+func TestAuthMethods(t *testing.T) {
+	tests := []struct {
+		name  string
+		empty bool
+		//passwords the server gets
+		passwords []string
+		prompts   []string
+	}{
+		{"keyboard-interactive after password", false,
+			[]string{"wrong", "wrong", "wrong"},
+			[]string{"password", "password", "password", "challenge"}},
+		{"empty password first", true,
+			[]string{"", "wrong", "wrong", "wrong"},
+			[]string{"password", "password", "password", "challenge"}},
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var passwords []string
+			server := &ssh.ServerConfig{
+				PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+					mu.Lock()
+					passwords = append(passwords, string(password))
+					mu.Unlock()
+					return nil, errors.New("wrong password")
+				},
+				KeyboardInteractiveCallback: func(_ ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					answers, err := challenge("", "", []string{"Code: "}, []bool{false})
+					if err != nil || len(answers) != 1 || answers[0] != "123456" {
+						return nil, errors.New("wrong code")
+					}
+					return nil, nil
+				},
+			}
+			server.AddHostKey(hostKey)
+
+			//the websocket of the session, and the one of the browser
+			conns := make(chan *websocket.Conn, 1)
+			hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				conns <- conn
+			}))
+			defer hs.Close()
+			bc, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prompts := make(chan []string, 1)
+			go func() { prompts <- browser(bc, "wrong", "123456") }()
+
+			ws := NewWebSSH(log.New(ioutil.Discard, "", 0))
+			ws.AddWebsocket(<-conns)
+			ws.SetEmptyPassword(tt.empty)
+
+			//both ends send their version first, which blocks over net.Pipe
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				if conn, _, _, err := ssh.NewServerConn(c, server); err == nil {
+					conn.Close()
+				}
+			}()
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			_, _, _, err = ssh.NewClientConn(c, "vm:22", &ssh.ClientConfig{
+				User:            "u",
+				Auth:            ws.AuthMethods(),
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws.websocket.Close()
+			bc.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(passwords, tt.passwords) {
+				t.Fatalf("passwords %q, want %q", passwords, tt.passwords)
+			}
+			if p := <-prompts; !reflect.DeepEqual(p, tt.prompts) {
+				t.Fatalf("prompts %q, want %q", p, tt.prompts)
+			}
+		})
+	}
+}
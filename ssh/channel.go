@@ -0,0 +1,230 @@
+package ssh
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/myml/webssh/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// channels a websocket may open besides the main terminal, set from ssh.max_channels
+var MaxChannels = 8
+
+// openChannel start a terminal, or the command of an exec message, on the
+// channel of msg over the ssh client of the session
+func (ws *WebSSH) openChannel(msg *message) error {
+	if msg.Channel <= 0 {
+		return errors.Errorf("channel %d invalid", msg.Channel)
+	}
+	ws.cmu.Lock()
+	if _, ok := ws.channels[msg.Channel]; ok {
+		ws.cmu.Unlock()
+		return errors.Errorf("channel %d in use", msg.Channel)
+	}
+	if len(ws.channels) >= MaxChannels {
+		ws.cmu.Unlock()
+		return errors.Errorf("too many channels, at most %d", MaxChannels)
+	}
+	//reserve the id while the session starts
+	if ws.channels == nil {
+		ws.channels = make(map[int]*session)
+	}
+	ws.channels[msg.Channel] = nil
+	ws.cmu.Unlock()
+
+	s, err := ws.newChannelSession(msg)
+	ws.cmu.Lock()
+	if err != nil {
+		delete(ws.channels, msg.Channel)
+	} else {
+		ws.channels[msg.Channel] = s
+	}
+	ws.cmu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	//confirm before any output of the channel
+	err = ws.broadcast(&message{Type: msg.Type, Channel: msg.Channel})
+	go ws.copyChannelOutput(msg.Channel, s)
+	return err
+}
+
+func (ws *WebSSH) newChannelSession(msg *message) (*session, error) {
+	s, err := ws.conn.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "ssh session")
+	}
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "ssh stdin")
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "ssh stdout")
+	}
+	stderr, err := s.StderrPipe()
+	if err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "ssh stderr")
+	}
+
+	rows, cols := msg.Rows, msg.Cols
+	if rows <= 0 || cols <= 0 {
+		rows, cols = 40, 80
+	}
+	//a channel is recorded like the main terminal, or not opened at all
+	var r *recorder
+	if RecordDir != "" {
+		name := castName(time.Now().Format("20060102-150405"), common.TokenHash(ws.token), ws.user, ws.id, strconv.Itoa(msg.Channel))
+		title := ws.user + "@" + ws.conn.RemoteAddr().String()
+		if msg.Type == messageTypeExec {
+			title += ": " + string(msg.Data)
+		}
+		if r, err = newRecorder(RecordDir, name, cols, rows, title); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	if msg.Type == messageTypeExec {
+		ws.logger.Printf("channel %d exec %q", msg.Channel, msg.Data)
+		err = errors.Wrap(s.Start(string(msg.Data)), "exec")
+	} else {
+		err = ws.startChannelShell(s, rows, cols)
+	}
+	if err != nil {
+		s.Close()
+		if r != nil {
+			r.close()
+		}
+		return nil, err
+	}
+	return &session{sess: s, stdin: stdin, stdout: stdout, stderr: stderr, recorder: r}, nil
+}
+
+func (ws *WebSSH) startChannelShell(s *ssh.Session, rows, cols int) error {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: ws.buffSize,
+		ssh.TTY_OP_OSPEED: ws.buffSize,
+	}
+	if err := s.RequestPty("xterm", rows, cols, modes); err != nil {
+		return errors.Wrap(err, "pty")
+	}
+	return errors.Wrap(s.Shell(), "shell")
+}
+
+// copyChannelOutput forward the output of the channel until it exits
+func (ws *WebSSH) copyChannelOutput(id int, s *session) {
+	var wg sync.WaitGroup
+	forward := func(t messageType, r io.Reader) {
+		defer wg.Done()
+		buff := make([]byte, ws.buffSize)
+		for {
+			n, err := r.Read(buff)
+			if err != nil {
+				return
+			}
+			if s.recorder != nil {
+				s.recorder.output(string(t), buff[:n])
+			}
+			if err = ws.broadcast(&message{Type: t, Channel: id, Data: buff[:n]}); err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go forward(messageTypeStdout, s.stdout)
+	go forward(messageTypeStderr, s.stderr)
+	wg.Wait()
+
+	exit := &message{Type: messageTypeExit, Channel: id, Code: exitCode(0)}
+	err := s.sess.Wait()
+	//closed by the client when no longer registered
+	if ws.channel(id) == s && err != nil {
+		if e, ok := err.(*ssh.ExitError); ok {
+			exit.Code = exitCode(e.ExitStatus())
+		} else {
+			exit.Code = nil
+			exit.Data = []byte(err.Error())
+		}
+	}
+	ws.cmu.Lock()
+	if ws.channels[id] == s {
+		delete(ws.channels, id)
+	}
+	ws.cmu.Unlock()
+	s.close()
+	ws.broadcast(exit)
+}
+
+func (ws *WebSSH) channel(id int) *session {
+	ws.cmu.Lock()
+	defer ws.cmu.Unlock()
+	return ws.channels[id]
+}
+
+func (ws *WebSSH) closeChannel(id int) {
+	ws.cmu.Lock()
+	s := ws.channels[id]
+	delete(ws.channels, id)
+	ws.cmu.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
+
+func (ws *WebSSH) closeChannels() {
+	ws.cmu.Lock()
+	channels := ws.channels
+	ws.channels = nil
+	ws.cmu.Unlock()
+	for _, s := range channels {
+		if s != nil {
+			s.close()
+		}
+	}
+}
+
+// channelMessage handle a message for one of the channels
+func (ws *WebSSH) channelMessage(msg *message) error {
+	switch msg.Type {
+	case messageTypeOpen, messageTypeExec:
+		if err := ws.openChannel(msg); err != nil {
+			ws.logger.Printf("channel %d open failed %s", msg.Channel, err)
+			return ws.writeJSON(&message{Type: msg.Type, Channel: msg.Channel, Code: exitCode(-1), Data: []byte(err.Error())})
+		}
+		return nil
+	case messageTypeClose:
+		ws.closeChannel(msg.Channel)
+		return nil
+	}
+
+	s := ws.channel(msg.Channel)
+	if s == nil {
+		return nil
+	}
+	switch msg.Type {
+	case messageTypeStdin:
+		if s.recorder != nil && RecordInput {
+			s.recorder.input(msg.Data)
+		}
+		ws.input(len(msg.Data))
+		if _, err := s.stdin.Write(msg.Data); err != nil {
+			ws.logger.Printf("channel %d write failed %s", msg.Channel, err)
+		}
+	case messageTypeResize:
+		if s.recorder != nil {
+			s.recorder.resize(msg.Cols, msg.Rows)
+		}
+		s.sess.WindowChange(msg.Rows, msg.Cols)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/myml/webssh/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	//longest time a command may run
+	ExecTimeout = 30 * time.Second
+	//bytes of stdout and stderr a command may write
+	ExecOutput = 1024 * 1024
+)
+
+// ExecRequest is the body of an exec http request
+type ExecRequest struct {
+	User       string `json:"user"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Command    string `json:"command"`
+	//seconds, at most ExecTimeout
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// AuthMethods of the credentials of the request
+func (r *ExecRequest) AuthMethods() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if r.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(r.PrivateKey))
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(r.PrivateKey), []byte(r.Passphrase))
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parse private key")
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	methods = append(methods,
+		ssh.Password(r.Password),
+		//answer password prompts of keyboard-interactive with the password
+		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = r.Password
+			}
+			return answers, nil
+		}),
+	)
+	return methods, nil
+}
+
+// ExecTimeoutOf the timeout in seconds asked by the client, capped to ExecTimeout
+func ExecTimeoutOf(seconds int) time.Duration {
+	timeout := time.Duration(seconds) * time.Second
+	if timeout <= 0 || timeout > ExecTimeout {
+		return ExecTimeout
+	}
+	return timeout
+}
+
+// ExecResult of a command run by an exec http request
+type ExecResult struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	//exit status, -1 when the command did not exit by itself
+	Code int `json:"code"`
+	//why the command failed or was stopped
+	Error     string `json:"error,omitempty"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// outputLimit is shared by the stdout and stderr of a command
+type outputLimit struct {
+	mu       sync.Mutex
+	left     int
+	exceeded chan struct{}
+}
+
+func newOutputLimit(n int) *outputLimit {
+	return &outputLimit{left: n, exceeded: make(chan struct{})}
+}
+
+// writer write to w until the limit is exceeded, discarding the rest
+func (l *outputLimit) writer(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		l.mu.Lock()
+		n := len(p)
+		if n > l.left {
+			n = l.left
+			if l.left >= 0 {
+				close(l.exceeded)
+			}
+		}
+		l.left -= len(p)
+		l.mu.Unlock()
+		if n <= 0 {
+			return len(p), nil
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+// recordOutput record what is written to w as the output stream t
+func recordOutput(r *recorder, t messageType, w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		r.output(string(t), p)
+		return w.Write(p)
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// execute run command until it exits, the timeout passes or the output limit
+// is exceeded, the error tells why it did not exit by itself
+func (ws *WebSSH) execute(command string, timeout time.Duration, stdout, stderr io.Writer) (*ExecResult, error) {
+	res := &ExecResult{Code: -1}
+	s, err := ws.conn.NewSession()
+	if err != nil {
+		return res, errors.Wrap(err, "ssh session")
+	}
+	defer s.Close()
+
+	ws.logger.Printf("exec %q on %s", command, ws.conn.RemoteAddr())
+	if RecordDir != "" {
+		name := castName(time.Now().Format("20060102-150405"), common.TokenHash(ws.token), ws.user, ws.id)
+		title := ws.user + "@" + ws.conn.RemoteAddr().String() + ": " + command
+		r, err := newRecorder(RecordDir, name, 80, 40, title)
+		if err != nil {
+			return res, err
+		}
+		defer r.close()
+		stdout, stderr = recordOutput(r, messageTypeStdout, stdout), recordOutput(r, messageTypeStderr, stderr)
+	}
+
+	limit := newOutputLimit(ExecOutput)
+	s.Stdout = limit.writer(stdout)
+	s.Stderr = limit.writer(stderr)
+	if err = s.Start(command); err != nil {
+		return res, errors.Wrap(err, "exec")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+	case <-timer.C:
+		res.TimedOut = true
+		err = errors.Errorf("timed out after %s", timeout)
+	case <-limit.exceeded:
+		res.Truncated = true
+		err = errors.Errorf("output exceeds %d bytes", ExecOutput)
+	}
+	if res.TimedOut || res.Truncated {
+		s.Signal(ssh.SIGKILL)
+		s.Close()
+		<-done
+		return res, err
+	}
+
+	if err == nil {
+		res.Code = 0
+		return res, nil
+	}
+	if e, ok := err.(*ssh.ExitError); ok {
+		res.Code = e.ExitStatus()
+		return res, nil
+	}
+	return res, err
+}
+
+// Run command over the ssh client, collecting its output
+func (ws *WebSSH) Run(command string, timeout time.Duration) *ExecResult {
+	var stdout, stderr bytes.Buffer
+	res, err := ws.execute(command, timeout, &stdout, &stderr)
+	res.Stdout = stdout.String()
+	res.Stderr = stderr.String()
+	if err != nil {
+		ws.logger.Printf("exec failed %s", err)
+		res.Error = err.Error()
+	}
+	ws.input(len(command))
+	ws.output(stdout.Len() + stderr.Len())
+	return res
+}
+
+// Exec wait for the exec message of the client then authenticate over conn,
+// asking the websocket for credentials, and run its command, streaming the
+// output and exit status
+func (ws *WebSSH) Exec(conn net.Conn, config *ssh.ClientConfig, timeout time.Duration) {
+	go func() {
+		defer ws.Cleanup()
+		msg, err := ws.readExec()
+		if err == nil {
+			err = ws.NewSSHClient(conn, config)
+		} else {
+			conn.Close()
+		}
+		if err != nil {
+			ws.logger.Printf("exec failed %s", err)
+			ws.writeJSON(&message{Type: messageTypeStderr, Data: []byte(err.Error() + "\r\n")})
+			common.Shutdown(ws.websocket, "exec failed")
+			return
+		}
+		ws.input(len(msg.Data))
+
+		//only control frames are expected from now on, read until the client is gone
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := ws.websocket.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		client := ws.conn
+		go func() {
+			<-gone
+			client.Close()
+		}()
+
+		res, err := ws.execute(string(msg.Data), timeout,
+			&execStream{ws: ws, t: messageTypeStdout},
+			&execStream{ws: ws, t: messageTypeStderr})
+		exit := &message{Type: messageTypeExit, Code: exitCode(res.Code)}
+		if err != nil {
+			ws.logger.Printf("exec failed %s", err)
+			exit.Data = []byte(err.Error())
+		}
+		ws.writeJSON(exit)
+		common.Shutdown(ws.websocket, "exit")
+		select {
+		case <-gone:
+		case <-time.After(time.Second):
+		}
+	}()
+}
+
+// readExec wait for the exec message sent by the client once connected
+func (ws *WebSSH) readExec() (*message, error) {
+	for {
+		msgType, data, err := common.ReadMessageWithIdleTime(ws.websocket, ws.logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "websocket read")
+		}
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		var msg message
+		if err = json.Unmarshal(data, &msg); err != nil {
+			return nil, errors.Wrap(err, "json unmarshal")
+		}
+		if msg.Type == messageTypeExec {
+			if len(msg.Data) == 0 {
+				return nil, errors.New("command missing")
+			}
+			return &msg, nil
+		}
+	}
+}
+
+// execStream write command output to the websocket
+type execStream struct {
+	ws *WebSSH
+	t  messageType
+}
+
+func (s *execStream) Write(p []byte) (int, error) {
+	if err := s.ws.writeJSON(&message{Type: s.t, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
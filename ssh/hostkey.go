@@ -0,0 +1,165 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type HostKeyPolicy string
+
+const (
+	//accept any host key, the legacy behaviour
+	HostKeyInsecure HostKeyPolicy = "insecure"
+	//only accept host keys already in known_hosts
+	HostKeyStrict HostKeyPolicy = "strict"
+	//trust on first use, record unknown hosts and reject changed keys
+	HostKeyTOFU HostKeyPolicy = "tofu"
+)
+
+// HostKeyChangedError reports a host key not matching the trusted one
+type HostKeyChangedError struct {
+	Host string
+	Want string
+	Got  string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key for %s changed, want %s got %s", e.Host, e.Want, e.Got)
+}
+
+// Warning text shown to the browser
+func (e *HostKeyChangedError) Warning() string {
+	return "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\r\n" +
+		"@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @\r\n" +
+		"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\r\n" +
+		"It is possible that someone is doing something nasty!\r\n" +
+		fmt.Sprintf("The fingerprint for the key sent by %s is\r\n%s\r\n", e.Host, e.Got) +
+		fmt.Sprintf("but the trusted fingerprint is\r\n%s\r\n", e.Want) +
+		"Host key verification failed.\r\n"
+}
+
+// KnownHosts verify host keys against a known_hosts file
+type KnownHosts struct {
+	mu       sync.Mutex
+	path     string
+	policy   HostKeyPolicy
+	callback ssh.HostKeyCallback
+}
+
+func NewKnownHosts(path string, policy HostKeyPolicy) (*KnownHosts, error) {
+	k := &KnownHosts{path: path, policy: policy}
+	switch policy {
+	case HostKeyInsecure:
+		return k, nil
+	case HostKeyStrict, HostKeyTOFU:
+	default:
+		return nil, errors.Errorf("unknown host key policy %q", policy)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "known_hosts dir")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "known_hosts")
+	}
+	f.Close()
+
+	if err = k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KnownHosts) load() error {
+	callback, err := knownhosts.New(k.path)
+	if err != nil {
+		return errors.Wrap(err, "load known_hosts")
+	}
+	k.callback = callback
+	return nil
+}
+
+func (k *KnownHosts) add(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open known_hosts")
+	}
+	defer f.Close()
+
+	addrs := []string{knownhosts.Normalize(hostname)}
+	if r := knownhosts.Normalize(remote.String()); r != addrs[0] {
+		addrs = append(addrs, r)
+	}
+	if _, err = f.WriteString(knownhosts.Line(addrs, key) + "\n"); err != nil {
+		return errors.Wrap(err, "write known_hosts")
+	}
+	return k.load()
+}
+
+func (k *KnownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	err := k.callback(hostname, remote, key)
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return err
+	}
+	if len(keyErr.Want) > 0 {
+		want := make([]string, 0, len(keyErr.Want))
+		for _, w := range keyErr.Want {
+			want = append(want, ssh.FingerprintSHA256(w.Key))
+		}
+		return &HostKeyChangedError{
+			Host: hostname,
+			Want: strings.Join(want, ", "),
+			Got:  ssh.FingerprintSHA256(key),
+		}
+	}
+	if k.policy != HostKeyTOFU {
+		return errors.Errorf("host key for %s is unknown", hostname)
+	}
+	return k.add(hostname, remote, key)
+}
+
+// HostKeyCallback verify against fingerprint when the token lookup provided one,
+// leaving known_hosts untouched as vm ips are reused, otherwise against known_hosts
+func (k *KnownHosts) HostKeyCallback(fingerprint string) ssh.HostKeyCallback {
+	if fingerprint != "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			got := ssh.FingerprintLegacyMD5(key)
+			if strings.HasPrefix(fingerprint, "SHA256:") {
+				got = ssh.FingerprintSHA256(key)
+			}
+			if got != fingerprint {
+				return &HostKeyChangedError{Host: hostname, Want: fingerprint, Got: got}
+			}
+			return nil
+		}
+	}
+	if k.policy == HostKeyInsecure {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return k.check
+}
+
+// VerifyHostKey wrap callback, warning the browser when the host key changed
+func (ws *WebSSH) VerifyHostKey(callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if e, ok := err.(*HostKeyChangedError); ok {
+			ws.logger.Printf("%s", e)
+			ws.writeJSON(&message{Type: messageTypeStderr, Data: []byte(e.Warning())})
+		}
+		return err
+	}
+}
@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	//the vm now at the ip, and the one pinned for it before
+	key, old := newHostKey(t), newHostKey(t)
+	tests := []struct {
+		name   string
+		policy HostKeyPolicy
+		pinned bool
+		//host key returned by the resolver
+		fingerprint string
+		err         bool
+		changed     bool
+		recorded    bool
+	}{
+		{"tofu resolver key over pin", HostKeyTOFU, true, ssh.FingerprintSHA256(key), false, false, false},
+		{"tofu resolver md5 key", HostKeyTOFU, true, ssh.FingerprintLegacyMD5(key), false, false, false},
+		{"tofu resolver key mismatch", HostKeyTOFU, false, ssh.FingerprintSHA256(old), true, true, false},
+		{"tofu pin changed", HostKeyTOFU, true, "", true, true, false},
+		{"tofu first use", HostKeyTOFU, false, "", false, false, true},
+		{"tofu resolver key not recorded", HostKeyTOFU, false, ssh.FingerprintSHA256(key), false, false, false},
+		{"strict unknown", HostKeyStrict, false, "", true, false, false},
+		{"strict resolver key", HostKeyStrict, false, ssh.FingerprintSHA256(key), false, false, false},
+		{"insecure", HostKeyInsecure, false, "", false, false, false},
+		{"insecure resolver key mismatch", HostKeyInsecure, false, ssh.FingerprintSHA256(old), true, true, false},
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 22}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "known_hosts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "known_hosts")
+			var pin []byte
+			if tt.pinned {
+				pin = []byte(knownhosts.Line([]string{knownhosts.Normalize(remote.String())}, old) + "\n")
+				if err = ioutil.WriteFile(path, pin, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			k, err := NewKnownHosts(path, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = k.HostKeyCallback(tt.fingerprint)(remote.String(), remote, key)
+			if (err != nil) != tt.err {
+				t.Fatalf("err %v", err)
+			}
+			if _, changed := err.(*HostKeyChangedError); changed != tt.changed {
+				t.Fatalf("err %v, want changed %v", err, tt.changed)
+			}
+			data, _ := ioutil.ReadFile(path)
+			if recorded := len(data) > len(pin); recorded != tt.recorded {
+				t.Fatalf("known_hosts %q, want recorded %v", data, tt.recorded)
+			}
+		})
+	}
+}
@@ -10,6 +10,15 @@ const (
 	messageTypeLogin     = "login"
 	messageTypePassword  = "password"
 	messageTypePublickey = "publickey"
+	messageTypeChallenge = "challenge"
+	messageTypeResume    = "resume"
+	messageTypeOpen      = "open"
+	messageTypeExec      = "exec"
+	messageTypeClose     = "close"
+	messageTypeExit      = "exit"
+	messageTypeAgent     = "agent"
+	messageTypeX11       = "x11"
+	messageTypeShare     = "share"
 )
 
 type message struct {
@@ -17,4 +26,18 @@ type message struct {
 	Data []byte      `json:"data"`
 	Cols int         `json:"cols,omitempty"`
 	Rows int         `json:"rows,omitempty"`
+	//0 is the main terminal, others are opened by the client
+	Channel int `json:"channel,omitempty"`
+	//exit status of a channel, 0 included
+	Code *int `json:"code,omitempty"`
+
+	// keyboard-interactive challenge and its answers
+	Instruction string   `json:"instruction,omitempty"`
+	Questions   []string `json:"questions,omitempty"`
+	Echos       []bool   `json:"echos,omitempty"`
+	Answers     []string `json:"answers,omitempty"`
+}
+
+func exitCode(code int) *int {
+	return &code
 }
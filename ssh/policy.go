@@ -0,0 +1,159 @@
+package ssh
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// SftpRule matches sftp operations, empty fields match anything
+type SftpRule struct {
+	//ssh login users, glob patterns
+	Users []string `json:"users,omitempty"`
+	//token scopes returned by the token lookup
+	Scopes []string `json:"scopes,omitempty"`
+	//operations, e.g. open read write remove rename mkdir
+	Ops []string `json:"ops,omitempty"`
+	//absolute path globs, a trailing /** matches the whole subtree
+	Paths  []string `json:"paths,omitempty"`
+	Action string   `json:"action"`
+}
+
+// SftpPolicy decides sftp operations by the first matching rule
+type SftpPolicy struct {
+	Default string     `json:"default,omitempty"`
+	Rules   []SftpRule `json:"rules"`
+
+	hasPaths bool
+}
+
+// DefaultSftpPolicy denies file downloads, the legacy behaviour
+func DefaultSftpPolicy() *SftpPolicy {
+	p := &SftpPolicy{
+		Rules: []SftpRule{{Ops: []string{"read"}, Action: PolicyDeny}},
+	}
+	p.init()
+	return p
+}
+
+func LoadSftpPolicy(file string) (*SftpPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "open sftp policy")
+	}
+	defer f.Close()
+
+	var p SftpPolicy
+	if err = json.NewDecoder(f).Decode(&p); err != nil {
+		return nil, errors.Wrap(err, "decode sftp policy")
+	}
+	if err = p.validate(); err != nil {
+		return nil, err
+	}
+	p.init()
+	return &p, nil
+}
+
+func (p *SftpPolicy) validate() error {
+	if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return errors.Errorf("sftp policy default %q invalid", p.Default)
+	}
+	for i, r := range p.Rules {
+		if r.Action != PolicyAllow && r.Action != PolicyDeny {
+			return errors.Errorf("sftp policy rule %d action %q invalid", i, r.Action)
+		}
+		for _, op := range r.Ops {
+			if !validOp(op) {
+				return errors.Errorf("sftp policy rule %d op %q unknown", i, op)
+			}
+		}
+		for _, g := range append(append(append([]string{}, r.Users...), r.Scopes...), r.Paths...) {
+			if _, err := path.Match(g, ""); err != nil {
+				return errors.Errorf("sftp policy rule %d pattern %q invalid", i, g)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *SftpPolicy) init() {
+	for _, r := range p.Rules {
+		if len(r.Paths) > 0 {
+			p.hasPaths = true
+		}
+	}
+}
+
+func validOp(op string) bool {
+	for _, o := range sftpOps {
+		if o == op {
+			return true
+		}
+	}
+	for _, o := range extendedOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(patterns []string, p string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/**") {
+			//the directory is a glob too, matched against p and its parents
+			dir := strings.TrimSuffix(pattern, "/**")
+			if dir == "" {
+				dir = "/"
+			}
+			for q := p; q != "" && q != "."; q = path.Dir(q) {
+				if ok, _ := path.Match(dir, q); ok {
+					return true
+				}
+				if q == "/" {
+					break
+				}
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed report whether user in scope may perform op on p
+func (p *SftpPolicy) Allowed(user, scope, op, file string) bool {
+	for _, r := range p.Rules {
+		if !matchAny(r.Users, user) || !matchAny(r.Scopes, scope) ||
+			!matchAny(r.Ops, op) || !matchPath(r.Paths, file) {
+			continue
+		}
+		return r.Action == PolicyAllow
+	}
+	return p.Default != PolicyDeny
+}
@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/home/**", "/home", true},
+		{"/home/**", "/home/u", true},
+		{"/home/**", "/home/u/a/b", true},
+		{"/home/**", "/homes", false},
+		{"/home/**", "/", false},
+		{"/**", "/", true},
+		{"/**", "/etc/passwd", true},
+		{"/home/*/.ssh/**", "/home/u/.ssh/id_rsa", true},
+		{"/home/*/.ssh/**", "/home/u/.ssh", true},
+		{"/home/*/.ssh/**", "/home/u/a/.ssh", false},
+		{"/home/*", "/home/u", true},
+		{"/home/*", "/home/u/a", false},
+		{"/tmp/*.txt", "/tmp/a.txt", true},
+		{"/tmp/[ab].txt", "/tmp/c.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			if match := matchPath([]string{tt.pattern}, tt.path); match != tt.match {
+				t.Fatalf("match %v, want %v", match, tt.match)
+			}
+		})
+	}
+}
+
+func TestSftpPolicyAllowed(t *testing.T) {
+	policy := &SftpPolicy{
+		Default: PolicyDeny,
+		Rules: []SftpRule{
+			{Users: []string{"root"}, Action: PolicyDeny},
+			{Scopes: []string{"tenant-a"}, Ops: []string{"read"}, Action: PolicyDeny},
+			{Ops: []string{"write", "remove"}, Paths: []string{"/srv/**"}, Action: PolicyAllow},
+			{Ops: []string{"open", "read", "stat"}, Action: PolicyAllow},
+		},
+	}
+	tests := []struct {
+		name    string
+		policy  *SftpPolicy
+		user    string
+		scope   string
+		op      string
+		path    string
+		allowed bool
+	}{
+		{"default read", DefaultSftpPolicy(), "u", "", "read", "/a", false},
+		{"default open", DefaultSftpPolicy(), "u", "", "open", "/a", true},
+		{"default write", DefaultSftpPolicy(), "u", "", "write", "/a", true},
+		{"first rule wins", policy, "root", "", "stat", "/a", false},
+		{"scope", policy, "u", "tenant-a", "read", "/a", false},
+		{"other scope", policy, "u", "tenant-b", "read", "/a", true},
+		{"path", policy, "u", "", "write", "/srv/a", true},
+		{"path outside", policy, "u", "", "write", "/etc/a", false},
+		{"op", policy, "u", "", "mkdir", "/srv/a", false},
+		{"default allow", &SftpPolicy{}, "u", "", "remove", "/a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := tt.policy.Allowed(tt.user, tt.scope, tt.op, tt.path); allowed != tt.allowed {
+				t.Fatalf("allowed %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestSftpPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SftpPolicy
+		err    bool
+	}{
+		{"empty", SftpPolicy{}, false},
+		{"hardlink", SftpPolicy{Rules: []SftpRule{{Ops: []string{"hardlink"}, Action: PolicyDeny}}}, false},
+		{"default", SftpPolicy{Default: "drop"}, true},
+		{"action", SftpPolicy{Rules: []SftpRule{{Action: "drop"}}}, true},
+		{"op", SftpPolicy{Rules: []SftpRule{{Ops: []string{"download"}, Action: PolicyDeny}}}, true},
+		{"pattern", SftpPolicy{Rules: []SftpRule{{Paths: []string{"/["}, Action: PolicyDeny}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); (err != nil) != tt.err {
+				t.Fatalf("err %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	//when set, terminal sessions are recorded into the dir in asciinema v2 format
+	RecordDir string
+	//record user input as well
+	RecordInput bool
+)
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes an asciinema v2 cast file
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	start time.Time
+	//incomplete utf8 sequence left by the previous chunk of a stream
+	partial map[string][]byte
+}
+
+func castName(parts ...string) string {
+	clean := func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}
+	for i, p := range parts {
+		parts[i] = strings.Map(clean, p)
+	}
+	return strings.Join(parts, "-") + ".cast"
+}
+
+func newRecorder(dir, name string, cols, rows int, title string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "record dir")
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "record file")
+	}
+
+	r := &recorder{
+		f:       f,
+		enc:     json.NewEncoder(f),
+		start:   time.Now(),
+		partial: make(map[string][]byte),
+	}
+	err = r.enc.Encode(&castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm"},
+	})
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "record header")
+	}
+	return r, nil
+}
+
+func (r *recorder) event(code string, data string) {
+	t := time.Since(r.start).Seconds()
+	if err := r.enc.Encode([]interface{}{t, code, data}); err != nil {
+		r.f.Close()
+		r.enc = nil
+	}
+}
+
+// write records data of stream, holding back an incomplete trailing utf8 sequence
+func (r *recorder) write(stream, code string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.enc == nil {
+		return
+	}
+
+	data = append(r.partial[stream], data...)
+	r.partial[stream] = nil
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				r.partial[stream] = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+	if len(data) > 0 {
+		r.event(code, string(data))
+	}
+}
+
+func (r *recorder) output(stream string, data []byte) {
+	r.write(stream, "o", data)
+}
+
+func (r *recorder) input(data []byte) {
+	r.write("stdin", "i", data)
+}
+
+func (r *recorder) resize(cols, rows int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.enc == nil {
+		return
+	}
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *recorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.enc == nil {
+		return
+	}
+	r.enc = nil
+	r.f.Close()
+}
@@ -0,0 +1,226 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/myml/webssh/common"
+	"github.com/pkg/errors"
+)
+
+var (
+	//time a session is kept after losing its websocket, 0 to end it at once
+	DetachGrace = time.Minute
+	//bytes of output kept for a detached session
+	DetachBuffer = 1024 * 1024
+)
+
+var (
+	resumableMu sync.Mutex
+	resumable   = make(map[string]*WebSSH)
+)
+
+// Resumable return the session of the resume token opened with token, nil if there is none
+func Resumable(resume, token string) *WebSSH {
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	ws, ok := resumable[resume]
+	if !ok || ws.token != token {
+		return nil
+	}
+	return ws
+}
+
+// issueResume send a new resume token to the websocket, revoking the previous one
+func (ws *WebSSH) issueResume() {
+	if DetachGrace <= 0 {
+		return
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		ws.logger.Printf("resume token failed %s", err)
+		return
+	}
+	resume := hex.EncodeToString(b)
+
+	resumableMu.Lock()
+	if ws.resume != "" {
+		delete(resumable, ws.resume)
+	}
+	ws.resume = resume
+	resumable[resume] = ws
+	resumableMu.Unlock()
+
+	ws.writeJSON(&message{Type: messageTypeResume, Data: []byte(resume)})
+}
+
+func (ws *WebSSH) revokeResume() {
+	resumableMu.Lock()
+	if ws.resume != "" {
+		delete(resumable, ws.resume)
+		ws.resume = ""
+	}
+	resumableMu.Unlock()
+}
+
+// canResume report whether a resume token has been issued for the session
+func (ws *WebSSH) canResume() bool {
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	return ws.resume != ""
+}
+
+// detachable report whether the websocket conn was lost rather than closed,
+// by the client or after the server asked it to close
+func detachable(conn *websocket.Conn, err error) bool {
+	return DetachGrace > 0 && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) &&
+		!common.ClosedByServer(conn)
+}
+
+// miss keep output written while the websocket is lost, called with wmu held
+func (ws *WebSSH) miss(msg *message) {
+	if msg.Channel != 0 {
+		ws.missChannel(msg)
+		return
+	}
+	if msg.Type != messageTypeStdout && msg.Type != messageTypeStderr {
+		return
+	}
+	ws.missed = append(ws.missed, msg.Data...)
+	if len(ws.missed) > DetachBuffer {
+		ws.missed = append([]byte(nil), ws.missed[len(ws.missed)-DetachBuffer:]...)
+	}
+}
+
+// missChannel keep the messages of the channels, dropping the oldest output
+// beyond DetachBuffer, called with wmu held
+func (ws *WebSSH) missChannel(msg *message) {
+	m := *msg
+	m.Data = append([]byte(nil), msg.Data...)
+	ws.missedChannels = append(ws.missedChannels, &m)
+	ws.missedSize += len(m.Data)
+	if ws.missedSize <= DetachBuffer {
+		return
+	}
+	//open and exit messages are kept
+	kept := ws.missedChannels[:0]
+	for _, m := range ws.missedChannels {
+		if ws.missedSize > DetachBuffer && (m.Type == messageTypeStdout || m.Type == messageTypeStderr) {
+			ws.missedSize -= len(m.Data)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	ws.missedChannels = kept
+}
+
+// detach keep the session after the websocket is lost, waiting for a resume
+// within the grace period, report whether it has been resumed. The session
+// stays registered until then, closing it ends the wait
+func (ws *WebSSH) detach() bool {
+	ws.wmu.Lock()
+	ws.detached = true
+	ws.resumed = make(chan struct{}, 1)
+	ws.abort = make(chan struct{})
+	conn, tracked, abort := ws.websocket, ws.tracked, ws.abort
+	ws.wmu.Unlock()
+
+	ws.logger.Printf("websocket lost, detached for %s", DetachGrace)
+	common.Shutdown(conn, "detached")
+	conn.Close()
+	if ws.ch != nil {
+		close(ws.ch)
+		ws.ch = nil
+	}
+	if tracked != nil {
+		tracked.Detach(ws.endDetached)
+	}
+
+	timer := time.NewTimer(DetachGrace)
+	defer timer.Stop()
+	ended := "expired"
+	select {
+	case <-ws.resumed:
+	case <-timer.C:
+	case <-abort:
+		ended = "closed"
+	}
+
+	ws.wmu.Lock()
+	if ws.detached {
+		//too late to resume from now on
+		ws.expired = true
+		ws.wmu.Unlock()
+		ws.logger.Printf("detached session %s", ended)
+		return false
+	}
+	ws.ch = make(chan struct{}, 1)
+	ws.wmu.Unlock()
+
+	//the sftp client starts over with the new websocket, rebuilt here as
+	//the session may be resumed as soon as Resume clears detached
+	if ws.sftpSess != nil {
+		ws.sftpSess.close()
+	}
+	if err := ws.NewSftpSession(); err != nil {
+		ws.logger.Printf("sftp restart failed %s", err)
+	} else {
+		go ws.copySftpOutput(ws.sftpSess.stdout, ws.sftp)
+	}
+	return true
+}
+
+// endDetached end the session if it is detached
+func (ws *WebSSH) endDetached() {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.detached && ws.abort != nil {
+		close(ws.abort)
+		ws.abort = nil
+	}
+}
+
+// Resume reattach a detached session to conn, replaying the output missed
+func (ws *WebSSH) Resume(conn *websocket.Conn, tracked *common.Session) error {
+	ws.wmu.Lock()
+	if !ws.detached || ws.expired {
+		ws.wmu.Unlock()
+		return errors.New("session not detached")
+	}
+	ws.websocket = conn
+	//the detached session is replaced by the one of conn
+	detached := ws.tracked
+	ws.tracked = tracked
+	ws.detached = false
+	ws.abort = nil
+	ws.broken = false
+	missed := len(ws.missed)
+	//replay before any new output
+	if missed > 0 {
+		ws.output(missed)
+		conn.WriteJSON(&message{Type: messageTypeStdout, Data: ws.missed})
+		ws.missed = nil
+	}
+	for _, m := range ws.missedChannels {
+		missed += len(m.Data)
+		ws.output(len(m.Data))
+		conn.WriteJSON(m)
+	}
+	ws.missedChannels, ws.missedSize = nil, 0
+	ws.wmu.Unlock()
+
+	ws.logger.Printf("resumed from %s with %d bytes missed", conn.RemoteAddr(), missed)
+	if detached != nil {
+		detached.Done()
+	}
+	if ws.tracked != nil {
+		ws.tracked.SetUser(ws.user)
+		ws.tracked.SetShare(ws.shareID)
+	}
+	ws.resumed <- struct{}{}
+	ws.issueResume()
+	return nil
+}
@@ -0,0 +1,415 @@
+package ssh
+
+import (
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// sftp packet types, draft-ietf-secsh-filexfer-02
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpRead          = 5
+	sshFxpWrite         = 6
+	sshFxpLstat         = 7
+	sshFxpFstat         = 8
+	sshFxpSetstat       = 9
+	sshFxpFsetstat      = 10
+	sshFxpOpendir       = 11
+	sshFxpReaddir       = 12
+	sshFxpRemove        = 13
+	sshFxpMkdir         = 14
+	sshFxpRmdir         = 15
+	sshFxpRealpath      = 16
+	sshFxpStat          = 17
+	sshFxpRename        = 18
+	sshFxpReadlink      = 19
+	sshFxpSymlink       = 20
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpData          = 103
+	sshFxpName          = 104
+	sshFxpAttrs         = 105
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+)
+
+// sftp status codes
+const (
+	sshFxOk               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxBadMessage       = 5
+	sshFxNoConnection     = 6
+	sshFxConnectionLost   = 7
+	sshFxOpUnsupported    = 8
+)
+
+// open flags
+const (
+	sshFxfRead   = 0x01
+	sshFxfWrite  = 0x02
+	sshFxfAppend = 0x04
+	sshFxfCreat  = 0x08
+	sshFxfTrunc  = 0x10
+)
+
+var sftpOps = map[byte]string{
+	sshFxpOpen:     "open",
+	sshFxpClose:    "close",
+	sshFxpRead:     "read",
+	sshFxpWrite:    "write",
+	sshFxpLstat:    "lstat",
+	sshFxpFstat:    "fstat",
+	sshFxpSetstat:  "setstat",
+	sshFxpFsetstat: "fsetstat",
+	sshFxpOpendir:  "opendir",
+	sshFxpReaddir:  "readdir",
+	sshFxpRemove:   "remove",
+	sshFxpMkdir:    "mkdir",
+	sshFxpRmdir:    "rmdir",
+	sshFxpRealpath: "realpath",
+	sshFxpStat:     "stat",
+	sshFxpRename:   "rename",
+	sshFxpReadlink: "readlink",
+	sshFxpSymlink:  "symlink",
+	sshFxpExtended: "extended",
+}
+
+// ops of the extended requests let through, the others are denied
+var extendedOps = map[string]string{
+	"posix-rename@openssh.com": "rename",
+	"hardlink@openssh.com":     "hardlink",
+	"statvfs@openssh.com":      "stat",
+	"fstatvfs@openssh.com":     "fstat",
+	"lsetstat@openssh.com":     "setstat",
+	"fsync@openssh.com":        "write",
+	"expand-path@openssh.com":  "realpath",
+	"limits@openssh.com":       "extended",
+}
+
+// sftpRequest is a decoded client packet
+type sftpRequest struct {
+	Type   byte
+	ID     uint32
+	Op     string
+	Name   string //name of an extended request
+	Path   string
+	Target string //new path of rename, file linked to by symlink and hardlink
+	Handle string
+	Flags  uint32 //pflags of open
+	Offset uint64
+	Length uint32 //requested length of read, data length of write
+}
+
+func unmarshalUint64(b []byte) (uint64, []byte) {
+	h, b := unmarshalUint32(b)
+	l, b := unmarshalUint32(b)
+	return uint64(h)<<32 | uint64(l), b
+}
+
+func unmarshalString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("sftp packet too short")
+	}
+	n, b := unmarshalUint32(b)
+	if uint32(len(b)) < n {
+		return "", nil, errors.New("sftp string too long")
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+// parseSftpRequest decode pkt, which includes the length field
+func parseSftpRequest(pkt []byte) (*sftpRequest, error) {
+	req := &sftpRequest{Type: pkt[4]}
+	if req.Type == sshFxpInit {
+		return req, nil
+	}
+	if len(pkt) < 9 {
+		return nil, errors.New("sftp packet too short")
+	}
+	req.Op = sftpOps[req.Type]
+	req.ID, _ = unmarshalUint32(pkt[5:])
+	b := pkt[9:]
+
+	var err error
+	switch req.Type {
+	case sshFxpOpen:
+		if req.Path, b, err = unmarshalString(b); err == nil {
+			if len(b) < 4 {
+				return nil, errors.New("sftp packet too short")
+			}
+			req.Flags, _ = unmarshalUint32(b)
+		}
+	case sshFxpRead, sshFxpWrite:
+		if req.Handle, b, err = unmarshalString(b); err == nil {
+			if len(b) < 12 {
+				return nil, errors.New("sftp packet too short")
+			}
+			req.Offset, b = unmarshalUint64(b)
+			req.Length, _ = unmarshalUint32(b)
+		}
+	case sshFxpClose, sshFxpFstat, sshFxpFsetstat, sshFxpReaddir:
+		req.Handle, _, err = unmarshalString(b)
+	case sshFxpLstat, sshFxpSetstat, sshFxpOpendir, sshFxpRemove, sshFxpMkdir,
+		sshFxpRmdir, sshFxpRealpath, sshFxpStat, sshFxpReadlink:
+		req.Path, _, err = unmarshalString(b)
+	case sshFxpRename:
+		if req.Path, b, err = unmarshalString(b); err == nil {
+			req.Target, _, err = unmarshalString(b)
+		}
+	case sshFxpSymlink:
+		//openssh sends the target before the link, the reverse of the draft
+		if req.Target, b, err = unmarshalString(b); err == nil {
+			req.Path, _, err = unmarshalString(b)
+		}
+	case sshFxpExtended:
+		var name string
+		if name, b, err = unmarshalString(b); err != nil {
+			break
+		}
+		req.Name = name
+		if op, ok := extendedOps[name]; ok {
+			req.Op = op
+		}
+		switch name {
+		case "posix-rename@openssh.com":
+			if req.Path, b, err = unmarshalString(b); err == nil {
+				req.Target, _, err = unmarshalString(b)
+			}
+		case "hardlink@openssh.com":
+			if req.Target, b, err = unmarshalString(b); err == nil {
+				req.Path, _, err = unmarshalString(b)
+			}
+		case "statvfs@openssh.com", "lsetstat@openssh.com", "expand-path@openssh.com":
+			req.Path, _, err = unmarshalString(b)
+		case "fstatvfs@openssh.com", "fsync@openssh.com":
+			req.Handle, _, err = unmarshalString(b)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func statusPacket(id uint32, code uint32, msg string) []byte {
+	langTag := "en"
+
+	l := 4 + 1 + 4 + // uint32(length)+byte(type)+uint32(id)
+		4 +
+		4 + len(msg) +
+		4 + len(langTag)
+	buf := make([]byte, 0, l)
+	buf = marshalUint32(buf, uint32(l-4))
+	buf = append(buf, sshFxpStatus)
+	buf = marshalUint32(buf, id)
+	buf = marshalUint32(buf, code)
+	buf = append(marshalUint32(buf, uint32(len(msg))), msg...)
+	buf = append(marshalUint32(buf, uint32(len(langTag))), langTag...)
+	return buf
+}
+
+// sftpHandle is an open file or directory
+type sftpHandle struct {
+	path    string
+	flags   uint32
+	dir     bool
+	read    uint64
+	written uint64
+}
+
+// sftpFilter split the browser's sftp stream into packets, applies the policy
+// and tracks replies to resolve handles to paths
+type sftpFilter struct {
+	policy *SftpPolicy
+	user   string
+	scope  string
+
+	audit *SftpAudit
+	//fields shared by every audit event of the session
+	event SftpEvent
+
+	in []byte
+
+	mu      sync.Mutex
+	home    string
+	pending map[uint32]*sftpRequest
+	handles map[string]*sftpHandle
+}
+
+func newSftpFilter(policy *SftpPolicy, user, scope string) *sftpFilter {
+	return &sftpFilter{
+		policy:  policy,
+		user:    user,
+		scope:   scope,
+		pending: make(map[uint32]*sftpRequest),
+		handles: make(map[string]*sftpHandle),
+	}
+}
+
+// abs resolve p against the home directory learned from realpath(".")
+func (f *sftpFilter) abs(p string) string {
+	if p == "" {
+		return p
+	}
+	if !path.IsAbs(p) && f.home != "" {
+		p = path.Join(f.home, p)
+	}
+	return path.Clean(p)
+}
+
+func (f *sftpFilter) relative(p string) bool {
+	return p != "" && !path.IsAbs(p)
+}
+
+func (f *sftpFilter) allowed(op, p string) bool {
+	return f.policy.Allowed(f.user, f.scope, op, p)
+}
+
+func (f *sftpFilter) check(req *sftpRequest) bool {
+	if req.Type == sshFxpInit {
+		return true
+	}
+	if req.Type == sshFxpExtended && extendedOps[req.Name] == "" {
+		return false
+	}
+	//relative paths can not be matched before the home directory is known
+	if req.Type != sshFxpRealpath && f.policy.hasPaths &&
+		(f.relative(req.Path) || f.relative(req.Target)) {
+		return false
+	}
+	if !f.allowed(req.Op, req.Path) {
+		return false
+	}
+	//read only denies SSH_FXP_READ as the legacy blacklist did, opening a file
+	//for reading is left to the open op
+	if req.Type == sshFxpOpen && req.Flags&(sshFxfWrite|sshFxfAppend|sshFxfCreat|sshFxfTrunc) != 0 &&
+		!f.allowed("write", req.Path) {
+		return false
+	}
+	if req.Target != "" && !f.allowed(req.Op, req.Target) {
+		return false
+	}
+	//a link is a new file whose content is read, or written too through a
+	//hardlink, from the file linked to
+	switch req.Op {
+	case "symlink":
+		return f.allowed("write", req.Path) && f.allowed("read", req.Target)
+	case "hardlink":
+		return f.allowed("write", req.Path) && f.allowed("read", req.Target) && f.allowed("write", req.Target)
+	}
+	return true
+}
+
+// request consume data from the browser, returning packets to forward to
+// the server and replies for denied packets
+func (f *sftpFilter) request(data []byte, maxSize uint32) (forward []byte, replies [][]byte, err error) {
+	f.in = append(f.in, data...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.in) >= 4 {
+		length, _ := unmarshalUint32(f.in)
+		if length == 0 || length > maxSize-4 {
+			return nil, nil, errors.Errorf("send packet %d bytes invalid", length)
+		}
+		if uint32(len(f.in)) < length+4 {
+			break
+		}
+		pkt := f.in[:length+4]
+		f.in = f.in[length+4:]
+
+		req, err := parseSftpRequest(pkt)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Path = f.abs(req.Path)
+		if req.Op == "symlink" && f.relative(req.Target) && path.IsAbs(req.Path) {
+			//relative to the directory of the link
+			req.Target = path.Join(path.Dir(req.Path), req.Target)
+		}
+		req.Target = f.abs(req.Target)
+		if h, ok := f.handles[req.Handle]; ok {
+			req.Path = h.path
+		}
+
+		if !f.check(req) {
+			f.record(req, nil, sshFxPermissionDenied, true)
+			replies = append(replies, statusPacket(req.ID, sshFxPermissionDenied, "permission denied"))
+			continue
+		}
+		if req.Type != sshFxpInit {
+			f.pending[req.ID] = req
+		}
+		forward = append(forward, pkt...)
+	}
+	if len(f.in) == 0 {
+		f.in = nil
+	}
+	return forward, replies, nil
+}
+
+// response track a server packet, which includes the length field
+func (f *sftpFilter) response(pkt []byte) {
+	if len(pkt) < 9 || pkt[4] == sshFxpVersion {
+		return
+	}
+	id, b := unmarshalUint32(pkt[5:])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	req, ok := f.pending[id]
+	if !ok {
+		return
+	}
+	delete(f.pending, id)
+
+	h := f.handles[req.Handle]
+	switch pkt[4] {
+	case sshFxpHandle:
+		if handle, _, err := unmarshalString(b); err == nil {
+			f.handles[handle] = &sftpHandle{
+				path:  req.Path,
+				flags: req.Flags,
+				dir:   req.Type == sshFxpOpendir,
+			}
+			f.record(req, nil, sshFxOk, false)
+		}
+	case sshFxpData:
+		if h != nil && len(b) >= 4 {
+			n, _ := unmarshalUint32(b)
+			h.read += uint64(n)
+		}
+	case sshFxpName:
+		if req.Type == sshFxpRealpath && req.Path == "." && len(b) >= 4 {
+			if home, _, err := unmarshalString(b[4:]); err == nil {
+				f.home = path.Clean(home)
+			}
+		}
+	case sshFxpStatus:
+		if len(b) < 4 {
+			return
+		}
+		code, _ := unmarshalUint32(b)
+		switch req.Type {
+		case sshFxpWrite:
+			if h != nil && code == sshFxOk {
+				h.written += uint64(req.Length)
+			}
+		case sshFxpClose:
+			if h != nil {
+				f.record(req, h, code, false)
+			}
+			delete(f.handles, req.Handle)
+		default:
+			f.record(req, nil, code, false)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package ssh
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sftpPacket build a packet of typ with the length field, fields are uint32
+// or string
+func sftpPacket(typ byte, id uint32, fields ...interface{}) []byte {
+	b := append([]byte{typ}, marshalUint32(nil, id)...)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			b = marshalUint32(b, v)
+		case uint64:
+			b = marshalUint32(marshalUint32(b, uint32(v>>32)), uint32(v))
+		case string:
+			b = append(marshalUint32(b, uint32(len(v))), v...)
+		}
+	}
+	return append(marshalUint32(nil, uint32(len(b))), b...)
+}
+
+func TestParseSftpRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  []byte
+		want sftpRequest
+		err  bool
+	}{
+		{"init", []byte{0, 0, 0, 5, sshFxpInit, 0, 0, 0, 3}, sftpRequest{Type: sshFxpInit}, false},
+		{"open", sftpPacket(sshFxpOpen, 1, "/a", uint32(sshFxfRead), uint32(0)),
+			sftpRequest{Type: sshFxpOpen, ID: 1, Op: "open", Path: "/a", Flags: sshFxfRead}, false},
+		{"read", sftpPacket(sshFxpRead, 2, "h", uint64(1<<32), uint32(4096)),
+			sftpRequest{Type: sshFxpRead, ID: 2, Op: "read", Handle: "h", Offset: 1 << 32, Length: 4096}, false},
+		{"rename", sftpPacket(sshFxpRename, 3, "/a", "/b"),
+			sftpRequest{Type: sshFxpRename, ID: 3, Op: "rename", Path: "/a", Target: "/b"}, false},
+		//openssh sends the target first
+		{"symlink", sftpPacket(sshFxpSymlink, 4, "/target", "/link"),
+			sftpRequest{Type: sshFxpSymlink, ID: 4, Op: "symlink", Path: "/link", Target: "/target"}, false},
+		{"hardlink", sftpPacket(sshFxpExtended, 5, "hardlink@openssh.com", "/target", "/link"),
+			sftpRequest{Type: sshFxpExtended, ID: 5, Op: "hardlink", Name: "hardlink@openssh.com", Path: "/link", Target: "/target"}, false},
+		{"posix rename", sftpPacket(sshFxpExtended, 6, "posix-rename@openssh.com", "/a", "/b"),
+			sftpRequest{Type: sshFxpExtended, ID: 6, Op: "rename", Name: "posix-rename@openssh.com", Path: "/a", Target: "/b"}, false},
+		{"fsync", sftpPacket(sshFxpExtended, 7, "fsync@openssh.com", "h"),
+			sftpRequest{Type: sshFxpExtended, ID: 7, Op: "write", Name: "fsync@openssh.com", Handle: "h"}, false},
+		{"unknown extended", sftpPacket(sshFxpExtended, 8, "copy-data", "h"),
+			sftpRequest{Type: sshFxpExtended, ID: 8, Op: "extended", Name: "copy-data"}, false},
+		{"no id", []byte{0, 0, 0, 3, sshFxpStat, 0, 0}, sftpRequest{}, true},
+		{"string past packet", []byte{0, 0, 0, 9, sshFxpStat, 0, 0, 0, 1, 0, 0, 0, 9}, sftpRequest{}, true},
+		{"string length cut", []byte{0, 0, 0, 7, sshFxpStat, 0, 0, 0, 1, 0, 0}, sftpRequest{}, true},
+		{"open without pflags", sftpPacket(sshFxpOpen, 1, "/a"), sftpRequest{}, true},
+		{"read without length", sftpPacket(sshFxpRead, 1, "h", uint64(0)), sftpRequest{}, true},
+		{"rename without target", sftpPacket(sshFxpRename, 1, "/a"), sftpRequest{}, true},
+		{"hardlink without link", sftpPacket(sshFxpExtended, 1, "hardlink@openssh.com", "/target"), sftpRequest{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseSftpRequest(tt.pkt)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parse %+v, want error", req)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *req != tt.want {
+				t.Fatalf("parse %+v, want %+v", *req, tt.want)
+			}
+		})
+	}
+}
+
+func TestSftpFilter(t *testing.T) {
+	//realpath(".") answered with /home/u
+	home := sftpPacket(sshFxpName, 100, uint32(1), "/home/u", "", uint32(0))
+	policy := &SftpPolicy{
+		Default: PolicyDeny,
+		Rules: []SftpRule{
+			{Ops: []string{"realpath", "stat"}, Action: PolicyAllow},
+			{Paths: []string{"/home/u/secret/**"}, Action: PolicyDeny},
+			{Paths: []string{"/home/u/**", "/tmp/*.txt"}, Action: PolicyAllow},
+		},
+	}
+	policy.init()
+	tests := []struct {
+		name string
+		//realpath(".") is answered before pkt
+		home    bool
+		pkt     []byte
+		forward bool
+	}{
+		{"relative before realpath", false, sftpPacket(sshFxpMkdir, 1, "docs", uint32(0)), false},
+		{"relative after realpath", true, sftpPacket(sshFxpMkdir, 1, "docs", uint32(0)), true},
+		{"realpath before realpath", false, sftpPacket(sshFxpRealpath, 1, "docs"), true},
+		{"dot dot after realpath", true, sftpPacket(sshFxpMkdir, 1, "../v/docs", uint32(0)), false},
+		{"subtree", false, sftpPacket(sshFxpRemove, 1, "/home/u/a/b/c"), true},
+		{"subtree root", false, sftpPacket(sshFxpOpendir, 1, "/home/u"), true},
+		{"subtree prefix", false, sftpPacket(sshFxpOpendir, 1, "/home/user"), false},
+		{"denied subtree", false, sftpPacket(sshFxpOpendir, 1, "/home/u/secret"), false},
+		{"denied subtree child", false, sftpPacket(sshFxpRemove, 1, "/home/u/secret/key"), false},
+		{"escape by dot dot", false, sftpPacket(sshFxpRemove, 1, "/home/u/../v/a"), false},
+		{"glob", false, sftpPacket(sshFxpRemove, 1, "/tmp/a.txt"), true},
+		{"glob nested", false, sftpPacket(sshFxpRemove, 1, "/tmp/a/b.txt"), false},
+		{"symlink", false, sftpPacket(sshFxpSymlink, 1, "/home/u/a", "/home/u/l"), true},
+		{"symlink to denied", false, sftpPacket(sshFxpSymlink, 1, "/home/u/secret/key", "/home/u/l"), false},
+		{"symlink relative target", false, sftpPacket(sshFxpSymlink, 1, "../secret/key", "/home/u/docs/l"), false},
+		{"symlink relative target allowed", false, sftpPacket(sshFxpSymlink, 1, "a", "/home/u/docs/l"), true},
+		{"hardlink to denied", false, sftpPacket(sshFxpExtended, 1, "hardlink@openssh.com", "/home/u/secret/key", "/home/u/l"), false},
+		{"unknown extended", false, sftpPacket(sshFxpExtended, 1, "copy-data", "h"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSftpFilter(policy, "u", "")
+			if tt.home {
+				forward, _, err := f.request(sftpPacket(sshFxpRealpath, 100, "."), 1<<15)
+				if err != nil || len(forward) == 0 {
+					t.Fatalf("realpath forward %x err %v", forward, err)
+				}
+				f.response(home)
+			}
+			forward, replies, err := f.request(tt.pkt, 1<<15)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.forward {
+				if !bytes.Equal(forward, tt.pkt) || len(replies) != 0 {
+					t.Fatalf("forward %x replies %x, want forwarded", forward, replies)
+				}
+				return
+			}
+			if len(forward) != 0 || len(replies) != 1 ||
+				!bytes.Equal(replies[0], statusPacket(1, sshFxPermissionDenied, "permission denied")) {
+				t.Fatalf("forward %x replies %x, want denied", forward, replies)
+			}
+		})
+	}
+}
+
+func TestSftpFilterLength(t *testing.T) {
+	stat := sftpPacket(sshFxpStat, 1, "/a")
+	tests := []struct {
+		name    string
+		data    [][]byte
+		forward []byte
+		err     bool
+	}{
+		{"split length", [][]byte{stat[:2], stat[2:]}, stat, false},
+		{"split body", [][]byte{stat[:7], stat[7:]}, stat, false},
+		{"two packets", [][]byte{append(append([]byte{}, stat...), stat...)}, append(append([]byte{}, stat...), stat...), false},
+		{"incomplete", [][]byte{stat[:len(stat)-1]}, nil, false},
+		{"zero length", [][]byte{{0, 0, 0, 0, sshFxpStat}}, nil, true},
+		{"over max size", [][]byte{{0, 0, 0x80, 0}}, nil, true},
+		{"body shorter than its string", [][]byte{{0, 0, 0, 9, sshFxpStat, 0, 0, 0, 1, 0, 0, 0, 9}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSftpFilter(DefaultSftpPolicy(), "u", "")
+			var forward []byte
+			var err error
+			for _, data := range tt.data {
+				var b []byte
+				if b, _, err = f.request(data, 1<<15); err != nil {
+					break
+				}
+				forward = append(forward, b...)
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("err %v", err)
+			}
+			if !bytes.Equal(forward, tt.forward) {
+				t.Fatalf("forward %x, want %x", forward, tt.forward)
+			}
+		})
+	}
+}
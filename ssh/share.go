@@ -0,0 +1,272 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/myml/webssh/common"
+	"github.com/pkg/errors"
+)
+
+const (
+	//watch the terminal only
+	ShareObserve = "observe"
+	//watch and type into the terminal
+	ShareCopilot = "copilot"
+)
+
+// bytes of terminal output replayed to websockets attaching late
+var ScrollbackSize = 64 * 1024
+
+var (
+	sharedMu sync.Mutex
+	//live sessions by share id
+	shared = make(map[string]*WebSSH)
+)
+
+// peer is an additional websocket attached to a session
+type peer struct {
+	conn    *websocket.Conn
+	copilot bool
+	tracked *common.Session
+	logger  *log.Logger
+	out     chan *message
+	//why the peer is detached by the server
+	reason string
+}
+
+// Shared return the live session of the share id opened with token, nil if there is none
+func Shared(share, token string) *WebSSH {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	ws, ok := shared[share]
+	if !ok || ws.token != token {
+		return nil
+	}
+	return ws
+}
+
+// SetShare let the holders of the share id join the session as observers, or
+// as copilots too, any other mode leaves joining to administrators
+func (ws *WebSSH) SetShare(mode string) *WebSSH {
+	if mode == ShareObserve || mode == ShareCopilot {
+		ws.shareMode = mode
+	}
+	return ws
+}
+
+// Joinable report whether the owner lets others join the session in mode
+func (ws *WebSSH) Joinable(mode string) bool {
+	return ws.shareMode == ShareCopilot || ws.shareMode == ShareObserve && mode == ShareObserve
+}
+
+// share register the session under a random share id, sent to the owner when
+// the session is shared with others
+func (ws *WebSSH) share() {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		ws.logger.Printf("share id failed %s", err)
+		return
+	}
+	id := hex.EncodeToString(b)
+
+	sharedMu.Lock()
+	ws.shareID = id
+	shared[id] = ws
+	sharedMu.Unlock()
+
+	if ws.tracked != nil {
+		ws.tracked.SetShare(id)
+	}
+	if ws.shareMode != "" {
+		ws.writeJSON(&message{Type: messageTypeShare, Data: []byte(id)})
+	}
+}
+
+// unshare stop sharing the session and detach all peers
+func (ws *WebSSH) unshare() {
+	sharedMu.Lock()
+	if ws.shareID != "" && shared[ws.shareID] == ws {
+		delete(shared, ws.shareID)
+	}
+	sharedMu.Unlock()
+
+	ws.pmu.Lock()
+	defer ws.pmu.Unlock()
+	ws.ended = true
+	for p := range ws.peers {
+		ws.drop(p, "session ended")
+	}
+}
+
+// Target is the address of the ssh server
+func (ws *WebSSH) Target() net.Addr {
+	return ws.target
+}
+
+// broadcast write terminal output to the websocket and all peers, keeping
+// it for peers attaching later
+func (ws *WebSSH) broadcast(msg *message) error {
+	ws.pmu.Lock()
+	if msg.Type == messageTypeResize {
+		ws.rows, ws.cols = msg.Rows, msg.Cols
+	} else if msg.Channel == 0 {
+		ws.keep(msg.Data)
+	}
+	if len(ws.peers) > 0 {
+		//the data buffer is reused by the caller
+		m := *msg
+		m.Data = append([]byte(nil), msg.Data...)
+		for p := range ws.peers {
+			select {
+			case p.out <- &m:
+			default:
+				ws.drop(p, "too slow")
+			}
+		}
+	}
+	ws.pmu.Unlock()
+
+	if msg.Type == messageTypeResize {
+		return nil
+	}
+	return ws.writeJSON(msg)
+}
+
+// keep data in the scrollback, which grows up to twice its size before
+// being trimmed to spare copies
+func (ws *WebSSH) keep(data []byte) {
+	if ScrollbackSize <= 0 {
+		return
+	}
+	ws.scrollback = append(ws.scrollback, data...)
+	if len(ws.scrollback) <= 2*ScrollbackSize {
+		return
+	}
+	sb := ws.scrollback[len(ws.scrollback)-ScrollbackSize:]
+	for len(sb) > 0 && !utf8.RuneStart(sb[0]) {
+		sb = sb[1:]
+	}
+	ws.scrollback = append(make([]byte, 0, 2*ScrollbackSize), sb...)
+}
+
+func (ws *WebSSH) replay() []byte {
+	sb := ws.scrollback
+	if len(sb) > ScrollbackSize {
+		sb = sb[len(sb)-ScrollbackSize:]
+		for len(sb) > 0 && !utf8.RuneStart(sb[0]) {
+			sb = sb[1:]
+		}
+	}
+	return append([]byte(nil), sb...)
+}
+
+// drop p with reason, called with pmu held
+func (ws *WebSSH) drop(p *peer, reason string) {
+	if _, ok := ws.peers[p]; !ok {
+		return
+	}
+	delete(ws.peers, p)
+	p.reason = reason
+	close(p.out)
+}
+
+// Attach conn to the session as an observer, or as a copilot whose input is
+// sent to the terminal, replaying the scrollback first
+func (ws *WebSSH) Attach(conn *websocket.Conn, mode string, tracked *common.Session, logger *log.Logger) error {
+	p := &peer{
+		conn:    conn,
+		copilot: mode == ShareCopilot,
+		tracked: tracked,
+		logger:  logger,
+		out:     make(chan *message, 256),
+	}
+
+	ws.pmu.Lock()
+	if ws.ended {
+		ws.pmu.Unlock()
+		return errors.New("session ended")
+	}
+	stdin := ws.sshSess.stdin
+	p.out <- &message{Type: messageTypeResize, Rows: ws.rows, Cols: ws.cols}
+	if sb := ws.replay(); len(sb) > 0 {
+		p.out <- &message{Type: messageTypeStdout, Data: sb}
+	}
+	if ws.peers == nil {
+		ws.peers = make(map[*peer]struct{})
+	}
+	ws.peers[p] = struct{}{}
+	ws.pmu.Unlock()
+
+	ws.logger.Printf("%s %s attached from %s", mode, tracked.ID, conn.RemoteAddr())
+	go ws.writePeer(p)
+	go ws.readPeer(p, stdin)
+	return nil
+}
+
+func (ws *WebSSH) writePeer(p *peer) {
+	defer p.tracked.Done()
+	defer p.conn.Close()
+	for msg := range p.out {
+		p.tracked.Output(len(msg.Data))
+		if err := p.conn.WriteJSON(msg); err != nil {
+			p.logger.Printf("peer write failed %s", err)
+			ws.pmu.Lock()
+			ws.drop(p, "")
+			ws.pmu.Unlock()
+			//drain until dropped
+			for range p.out {
+			}
+			return
+		}
+	}
+	if p.reason != "" {
+		common.Shutdown(p.conn, p.reason)
+	}
+}
+
+func (ws *WebSSH) readPeer(p *peer, stdin io.Writer) {
+	ch := make(chan struct{}, 1)
+	defer close(ch)
+	go func() {
+		if ok := common.KeepAlive(p.conn, ch, p.logger); !ok {
+			p.conn.Close()
+		}
+	}()
+	defer func() {
+		ws.pmu.Lock()
+		ws.drop(p, "")
+		ws.pmu.Unlock()
+	}()
+
+	for {
+		msgType, data, err := p.conn.ReadMessage()
+		if err != nil {
+			p.logger.Printf("peer read failed %s", err)
+			return
+		}
+		var msg message
+		if msgType != websocket.TextMessage || json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		//copilots type into the main terminal only
+		if msg.Type != messageTypeStdin || msg.Channel != 0 || !p.copilot {
+			continue
+		}
+		p.tracked.Input(len(msg.Data))
+		if ws.recorder != nil && RecordInput {
+			ws.recorder.input(msg.Data)
+		}
+		if _, err = stdin.Write(msg.Data); err != nil {
+			p.logger.Printf("peer write ssh failed %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/myml/webssh/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	//ports tunnels may reach on the remote side, none disables tunnels
+	TunnelPorts []uint16
+	//hosts tunnels may reach on the remote side, * for any
+	TunnelHosts = []string{"localhost", "127.0.0.1", "::1"}
+)
+
+// TunnelAllowed report whether a tunnel may reach host:port from the vm
+func TunnelAllowed(host string, port uint16) bool {
+	allowed := false
+	for _, p := range TunnelPorts {
+		if p == port {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	for _, h := range TunnelHosts {
+		if h == "*" || h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Tunnel authenticate over conn, asking the websocket for credentials, then
+// carry the binary messages of the websocket to host:port dialed from the vm
+func (ws *WebSSH) Tunnel(conn net.Conn, config *ssh.ClientConfig, host string, port uint16) {
+	go func() {
+		defer ws.Cleanup()
+		addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		err := ws.NewSSHClient(conn, config)
+		var remote net.Conn
+		if err == nil {
+			remote, err = ws.conn.Dial("tcp", addr)
+			err = errors.Wrap(err, "tunnel dial")
+		}
+		if err != nil {
+			ws.logger.Printf("tunnel to %s failed %s", addr, err)
+			ws.writeJSON(&message{Type: messageTypeStderr, Data: []byte(err.Error() + "\r\n")})
+			common.Shutdown(ws.websocket, "tunnel failed")
+			return
+		}
+		ws.logger.Printf("tunnel %s->%s via %s", ws.websocket.RemoteAddr(), addr, ws.conn.RemoteAddr())
+		//the stream starts once acknowledged
+		if err = ws.writeJSON(&message{Type: messageTypeOpen}); err != nil {
+			remote.Close()
+			return
+		}
+		ws.keepAlive()
+		copied := make(chan struct{})
+		go func() {
+			defer close(copied)
+			ws.copyTunnelOutput(remote, ws.websocket)
+		}()
+		//the output stops before the websocket is cleaned up
+		defer func() {
+			remote.Close()
+			<-copied
+		}()
+		for {
+			msgType, data, err := common.ReadMessageWithIdleTime(ws.websocket, ws.logger)
+			if err != nil {
+				ws.logger.Printf("tunnel websocket read failed %s", err)
+				return
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			ws.input(len(data))
+			if _, err = remote.Write(data); err != nil {
+				ws.logger.Printf("tunnel write failed %s", err)
+				common.Shutdown(ws.websocket, "tunnel closed")
+				return
+			}
+		}
+	}()
+}
+
+func (ws *WebSSH) copyTunnelOutput(remote net.Conn, conn *websocket.Conn) {
+	buff := make([]byte, ws.buffSize)
+	for {
+		n, err := remote.Read(buff)
+		if n > 0 {
+			if err := ws.writeMessage(websocket.BinaryMessage, buff[:n]); err != nil {
+				ws.logger.Printf("tunnel websocket write failed %s", err)
+				return
+			}
+		}
+		if err != nil {
+			ws.logger.Printf("tunnel read %v", err)
+			common.Shutdown(conn, "tunnel closed")
+			return
+		}
+	}
+}
@@ -5,7 +5,8 @@ import (
 	"io"
 	"log"
 	"net"
-	"os"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/myml/webssh/common"
@@ -27,6 +28,9 @@ type session struct {
 	stdin  io.WriteCloser
 	stdout io.Reader
 	stderr io.Reader
+
+	//records a channel opened by the client
+	recorder *recorder
 }
 
 func (s *session) close() {
@@ -36,6 +40,9 @@ func (s *session) close() {
 	if s.stdin != nil {
 		s.stdin.Close()
 	}
+	if s.recorder != nil {
+		s.recorder.close()
+	}
 }
 
 type WebSSH struct {
@@ -47,10 +54,70 @@ type WebSSH struct {
 	sftpSess  *session
 	ch        chan struct{}
 	banner    string
+	rows      int
+	cols      int
+
+	id         string
+	token      string
+	user       string
+	scope      string
+	sftpPolicy *SftpPolicy
+	sftpAudit  *SftpAudit
+	sftp       *sftpFilter
+	recorder   *recorder
+	tracked    *common.Session
+	target     net.Addr
+	//credentials sent to the server
+	authTries int
+	//try an empty password first
+	emptyPassword bool
+
+	//serialize writes to websocket
+	wmu sync.Mutex
+
+	//websockets attached to the session
+	shareID    string
+	shareMode  string
+	pmu        sync.Mutex
+	peers      map[*peer]struct{}
+	scrollback []byte
+	ended      bool
+
+	//the websocket is lost and output is kept until resumed
+	resume   string
+	detached bool
+	expired  bool
+	broken   bool
+	missed   []byte
+	//messages of the channels, in order, and the bytes of their output
+	missedChannels []*message
+	missedSize     int
+	resumed        chan struct{}
+	//closed to end the session while detached
+	abort chan struct{}
+
+	//sessions opened by the client over the ssh client, by channel id
+	cmu      sync.Mutex
+	channels map[int]*session
+
+	//agent requests forwarded to the browser, one at a time
+	agent        bool
+	amu          sync.Mutex
+	agentReplies chan []byte
+
+	//x11 connections waiting for the browser, by id
+	x11        bool
+	x11Cookie  []byte
+	xmu        sync.Mutex
+	x11Pending map[string]*x11Channel
 }
 
 func (ws *WebSSH) Cleanup() {
 	ws.logger.Printf("cleanup")
+	ws.unshare()
+	ws.revokeResume()
+	ws.closeChannels()
+	ws.closeX11()
 	if ws.sshSess != nil {
 		ws.sshSess.close()
 		ws.sshSess = nil
@@ -71,6 +138,12 @@ func (ws *WebSSH) Cleanup() {
 		close(ws.ch)
 		ws.ch = nil
 	}
+	if ws.recorder != nil {
+		ws.recorder.close()
+	}
+	if ws.tracked != nil {
+		ws.tracked.Done()
+	}
 }
 
 // SetBuffSize set buff size
@@ -79,11 +152,94 @@ func (ws *WebSSH) SetBuffSize(buffSize uint32) *WebSSH {
 	return ws
 }
 
+// SetSession set the websocket id and token of the session
+func (ws *WebSSH) SetSession(id, token string) *WebSSH {
+	ws.id = id
+	ws.token = token
+	return ws
+}
+
+// Track set the registered session, done when the session is cleaned up
+func (ws *WebSSH) Track(s *common.Session) *WebSSH {
+	ws.tracked = s
+	return ws
+}
+
+// SetSftpPolicy set the sftp policy applied to the session of the token scope
+func (ws *WebSSH) SetSftpPolicy(policy *SftpPolicy, scope string) *WebSSH {
+	ws.sftpPolicy = policy
+	ws.scope = scope
+	return ws
+}
+
+// SetSftpAudit set the log receiving sftp events of the session
+func (ws *WebSSH) SetSftpAudit(audit *SftpAudit) *WebSSH {
+	ws.sftpAudit = audit
+	return ws
+}
+
+func (ws *WebSSH) writeJSON(msg *message) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.detached || ws.broken {
+		ws.miss(msg)
+		return nil
+	}
+	ws.output(len(msg.Data))
+	err := ws.websocket.WriteJSON(msg)
+	if err != nil && ws.canResume() {
+		//keep the output until the read side notices and detaches
+		ws.broken = true
+		ws.miss(msg)
+		return nil
+	}
+	return err
+}
+
+func (ws *WebSSH) writeMessage(msgType int, data []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.detached {
+		return errors.New("detached")
+	}
+	ws.output(len(data))
+	return ws.websocket.WriteMessage(msgType, data)
+}
+
+func (ws *WebSSH) input(n int) {
+	if ws.tracked != nil {
+		ws.tracked.Input(n)
+	}
+}
+
+func (ws *WebSSH) output(n int) {
+	if ws.tracked != nil {
+		ws.tracked.Output(n)
+	}
+}
+
 // AddWebsocket add websocket connect
 func (ws *WebSSH) AddWebsocket(conn *websocket.Conn) {
 	ws.websocket = conn
+}
 
+// Connect authenticate over conn, asking the websocket for credentials, then serve the terminal
+func (ws *WebSSH) Connect(conn net.Conn, config *ssh.ClientConfig) {
 	go func() {
+		err := ws.NewSSHClient(conn, config)
+		if err == nil {
+			err = ws.NewSSHXtermSession()
+			if err == nil {
+				err = ws.NewSftpSession()
+			}
+		}
+		if err != nil {
+			ws.logger.Printf("ssh create sessions failed %s", err)
+			ws.writeJSON(&message{Type: messageTypeStderr, Data: []byte(err.Error() + "\r\n")})
+			common.Shutdown(ws.websocket, "ssh connect failed")
+			ws.Cleanup()
+			return
+		}
 		ws.logger.Printf("server exit %v", ws.server())
 	}()
 }
@@ -94,15 +250,21 @@ func (ws *WebSSH) server() error {
 	defer ws.Cleanup()
 
 	if ws.banner != "" {
-		ws.websocket.WriteJSON(&message{Type: messageTypeStderr, Data: []byte(ws.banner)})
+		ws.writeJSON(&message{Type: messageTypeStderr, Data: []byte(ws.banner)})
 	}
-	go func() {
-		if ok := common.KeepAlive(ws.websocket, ws.ch, ws.logger); !ok {
-			ws.Cleanup()
+	ws.keepAlive()
+
+	if RecordDir != "" {
+		name := castName(time.Now().Format("20060102-150405"), common.TokenHash(ws.token), ws.user, ws.id)
+		title := ws.user + "@" + ws.conn.RemoteAddr().String()
+		r, err := newRecorder(RecordDir, name, ws.cols, ws.rows, title)
+		if err != nil {
+			return err
 		}
-	}()
+		ws.recorder = r
+	}
 
-	if err := ws.transformOutput(ws.sshSess, ws.sftpSess, ws.websocket); err != nil {
+	if err := ws.transformOutput(ws.sshSess, ws.sftpSess); err != nil {
 		return err
 	}
 
@@ -110,38 +272,35 @@ func (ws *WebSSH) server() error {
 	if err := ws.sshSess.sess.Shell(); err != nil {
 		return errors.Wrap(err, "shell")
 	}
+	ws.share()
+	ws.issueResume()
 	for {
 		var msg message
 
 		msgType, data, err := common.ReadMessageWithIdleTime(ws.websocket, ws.logger)
 
 		if err != nil {
-			return errors.Wrap(err, "websocket read")
+			if !detachable(ws.websocket, err) || !ws.detach() {
+				return errors.Wrap(err, "websocket read")
+			}
+			ws.keepAlive()
+			continue
 		}
 		if msgType == websocket.BinaryMessage {
-			if data[4] == 5 { //blacklist SSH_FXP_READ
-				errMsg := os.ErrPermission.Error()
-				langTag := "en"
-
-				l := 4 + 1 + 4 + // uint32(length)+byte(type)+uint32(id)
-					4 +
-					4 + len(errMsg) +
-					4 + len(langTag)
-				buf := make([]byte, 0, l)
-				buf = marshalUint32(buf, uint32(l-4))
-				buf = append(buf, byte(101))    //type SSH_FXP_STATUS
-				buf = append(buf, data[5:9]...) //id
-				buf = marshalUint32(buf, 3)     //code SSH_FX_PERMISSION_DENIED
-				buf = append(marshalUint32(buf, uint32(len(errMsg))), errMsg...)
-				buf = append(marshalUint32(buf, uint32(len(langTag))), langTag...)
-
-				err = ws.websocket.WriteMessage(websocket.BinaryMessage, buf)
-				if err != nil {
-					return errors.Wrap(err, "deny read")
+			ws.input(len(data))
+			forward, replies, err := ws.sftp.request(data, ws.buffSize)
+			if err != nil {
+				return errors.Wrap(err, "sftp request")
+			}
+			for _, reply := range replies {
+				if err = ws.writeMessage(websocket.BinaryMessage, reply); err != nil {
+					return errors.Wrap(err, "deny sftp")
 				}
+			}
+			if len(forward) == 0 {
 				continue
 			}
-			_, err = ws.sftpSess.stdin.Write(data)
+			_, err = ws.sftpSess.stdin.Write(forward)
 			if err != nil {
 				return errors.Wrap(err, "write sftp")
 			}
@@ -150,28 +309,65 @@ func (ws *WebSSH) server() error {
 			if err != nil {
 				return errors.Wrap(err, "json unmarshal")
 			}
+			if msg.Channel != 0 || msg.Type == messageTypeOpen || msg.Type == messageTypeExec || msg.Type == messageTypeClose {
+				if err = ws.channelMessage(&msg); err != nil {
+					return errors.Wrap(err, "channel")
+				}
+				continue
+			}
 			switch msg.Type {
 			case messageTypeStdin:
+				if ws.recorder != nil && RecordInput {
+					ws.recorder.input(msg.Data)
+				}
+				ws.input(len(msg.Data))
 				_, err = ws.sshSess.stdin.Write(msg.Data)
 				if err != nil {
 					return errors.Wrap(err, "write ssh")
 				}
 			case messageTypeResize:
+				if ws.recorder != nil {
+					ws.recorder.resize(msg.Cols, msg.Rows)
+				}
+				ws.broadcast(&message{Type: messageTypeResize, Rows: msg.Rows, Cols: msg.Cols})
 				err = ws.sshSess.sess.WindowChange(msg.Rows, msg.Cols)
 				if err != nil {
 					return errors.Wrap(err, "resize")
 				}
+			case messageTypeAgent:
+				ws.agentReply(msg.Data)
 			}
 		}
 	}
 }
 
+// keepAlive ping the websocket, closing it when the client is gone
+func (ws *WebSSH) keepAlive() {
+	conn, ch := ws.websocket, ws.ch
+	go func() {
+		if ok := common.KeepAlive(conn, ch, ws.logger); !ok {
+			conn.Close()
+		}
+	}()
+}
+
 func (ws *WebSSH) NewSSHClient(conn net.Conn, config *ssh.ClientConfig) error {
 	var err error
+	if config.User == "" {
+		if config.User, err = ws.login(); err != nil {
+			conn.Close()
+			return err
+		}
+	}
 	c, chans, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), config)
 	if err != nil {
 		return errors.Wrap(err, "tcp client")
 	}
+	ws.user = config.User
+	ws.target = conn.RemoteAddr()
+	if ws.tracked != nil {
+		ws.tracked.SetUser(ws.user)
+	}
 	ws.conn = ssh.NewClient(c, chans, reqs)
 	return nil
 }
@@ -189,12 +385,28 @@ func (ws *WebSSH) NewSSHXtermSession() error {
 		ssh.TTY_OP_ISPEED: ws.buffSize,
 		ssh.TTY_OP_OSPEED: ws.buffSize,
 	}
+	rows, cols := 40, 80
+	if ws.rows > 0 && ws.cols > 0 {
+		rows, cols = ws.rows, ws.cols
+	}
 	// Request pseudo terminal
-	err = s.RequestPty("xterm", 40, 80, modes)
+	err = s.RequestPty("xterm", rows, cols, modes)
 	if err != nil {
 		s.Close()
 		return errors.Wrap(err, "pty")
 	}
+	ws.rows, ws.cols = rows, cols
+	if ws.agent {
+		//the shell works without the agent, as with openssh
+		if err = ws.forwardAgent(s); err != nil {
+			ws.logger.Printf("%s", err)
+		}
+	}
+	if ws.x11 {
+		if err = ws.forwardX11(s); err != nil {
+			ws.logger.Printf("%s", err)
+		}
+	}
 
 	stdin, err := s.StdinPipe()
 	if err != nil {
@@ -229,6 +441,20 @@ func (ws *WebSSH) NewSftpSession() error {
 	if err := s.RequestSubsystem("sftp"); err != nil {
 		return errors.Wrap(err, "sftp subsystem")
 	}
+	if ws.sftpPolicy == nil {
+		ws.sftpPolicy = DefaultSftpPolicy()
+	}
+	ws.sftp = newSftpFilter(ws.sftpPolicy, ws.user, ws.scope)
+	if ws.sftpAudit != nil {
+		target, _, _ := net.SplitHostPort(ws.conn.RemoteAddr().String())
+		ws.sftp.audit = ws.sftpAudit
+		ws.sftp.event = SftpEvent{
+			Session: ws.id,
+			Token:   common.TokenHash(ws.token),
+			User:    ws.user,
+			Target:  target,
+		}
+	}
 
 	stdin, err := s.StdinPipe()
 	if err != nil {
@@ -257,57 +483,66 @@ func unmarshalUint32(b []byte) (uint32, []byte) {
 	return v, b[4:]
 }
 
-func (ws *WebSSH) transformOutput(ssh *session, sftp *session, conn *websocket.Conn) error {
+func (ws *WebSSH) transformOutput(ssh *session, sftp *session) error {
 	copyShellOutput := func(t messageType, r io.Reader) {
 		buff := make([]byte, ws.buffSize)
 		for {
 			n, err := r.Read(buff)
 			if err != nil {
 				ws.logger.Printf("%s read failed %v", t, err)
+				if t == messageTypeStdout {
+					//the shell exited, nothing is left to resume
+					ws.endDetached()
+				}
 				return
 			}
-			err = conn.WriteJSON(&message{Type: t, Data: buff[:n]})
+			if ws.recorder != nil {
+				ws.recorder.output(string(t), buff[:n])
+			}
+			err = ws.broadcast(&message{Type: t, Data: buff[:n]})
 			if err != nil {
 				ws.logger.Printf("%s write failed %s", t, err)
 				return
 			}
 		}
 	}
-	copySftpOutput := func(r io.Reader) {
-		buf := make([]byte, ws.buffSize)
-		for {
-			if _, err := io.ReadFull(r, buf[:4]); err != nil {
-				ws.logger.Printf("sftp read length failed %v", err)
-				return
-			}
-			length, _ := unmarshalUint32(buf)
-			if length > ws.buffSize-4 {
-				ws.logger.Printf("recv packet %d bytes too long", length)
-				return
-			}
-			if length == 0 {
-				ws.logger.Printf("recv packet of 0 bytes too short")
-				return
-			}
-			if _, err := io.ReadFull(r, buf[4:length+4]); err != nil {
-				ws.logger.Printf("recv packet %d bytes: err %v", length, err)
-				return
-			}
-			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:length+4]); err != nil {
-				ws.logger.Printf("sftp write failed %v", err)
-				return
-			}
-		}
-	}
 	go copyShellOutput(messageTypeStdout, ssh.stdout)
 	go copyShellOutput(messageTypeStderr, ssh.stderr)
-	go copySftpOutput(sftp.stdout)
+	go ws.copySftpOutput(sftp.stdout, ws.sftp)
 	return nil
 }
 
+func (ws *WebSSH) copySftpOutput(r io.Reader, filter *sftpFilter) {
+	buf := make([]byte, ws.buffSize)
+	for {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			ws.logger.Printf("sftp read length failed %v", err)
+			return
+		}
+		length, _ := unmarshalUint32(buf)
+		if length > ws.buffSize-4 {
+			ws.logger.Printf("recv packet %d bytes too long", length)
+			return
+		}
+		if length == 0 {
+			ws.logger.Printf("recv packet of 0 bytes too short")
+			return
+		}
+		if _, err := io.ReadFull(r, buf[4:length+4]); err != nil {
+			ws.logger.Printf("recv packet %d bytes: err %v", length, err)
+			return
+		}
+		filter.response(buf[:length+4])
+		if err := ws.writeMessage(websocket.BinaryMessage, buf[:length+4]); err != nil {
+			ws.logger.Printf("sftp write failed %v", err)
+			return
+		}
+	}
+}
+
 func (ws *WebSSH) BannerDisplay(msg string) error {
 	if ws.websocket != nil {
-		return ws.websocket.WriteJSON(&message{Type: messageTypeStderr, Data: []byte(msg)})
+		return ws.writeJSON(&message{Type: messageTypeStderr, Data: []byte(msg)})
 	} else {
 		ws.banner = msg
 	}
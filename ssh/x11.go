@@ -0,0 +1,260 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/myml/webssh/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const x11AuthProtocol = "MIT-MAGIC-COOKIE-1"
+
+// time an x11 connection waits for the browser to attach to it, and for its
+// client to send the connection setup
+var X11Wait = 30 * time.Second
+
+var (
+	x11Mu sync.Mutex
+	//sessions of the x11 connections waiting for the browser, by id
+	x11Owners = make(map[string]*WebSSH)
+)
+
+// X11Session return the session of the x11 connection id opened with token,
+// nil if there is none
+func X11Session(id, token string) *WebSSH {
+	x11Mu.Lock()
+	defer x11Mu.Unlock()
+	ws, ok := x11Owners[id]
+	if !ok || ws.token != token {
+		return nil
+	}
+	return ws
+}
+
+// x11Channel is an x11 client connection waiting for the browser
+type x11Channel struct {
+	ch ssh.Channel
+	//connection setup of the client, without its authorization
+	setup []byte
+	timer *time.Timer
+}
+
+// SetX11Forwarding forward x11 clients started in the shell to the browser
+func (ws *WebSSH) SetX11Forwarding(forward bool) *WebSSH {
+	ws.x11 = forward
+	return ws
+}
+
+// forwardX11 ask the server to forward x11 connections of s, authorized by a
+// cookie only known to the session
+func (ws *WebSSH) forwardX11(s *ssh.Session) error {
+	chans := ws.conn.HandleChannelOpen("x11")
+	if chans == nil {
+		return errors.New("x11 channel already handled")
+	}
+	ws.x11Cookie = make([]byte, 16)
+	if _, err := rand.Read(ws.x11Cookie); err != nil {
+		return errors.Wrap(err, "x11 cookie")
+	}
+	go func() {
+		for nc := range chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				ws.logger.Printf("x11 channel accept failed %s", err)
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go ws.pendX11(ch)
+		}
+	}()
+
+	req := struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{
+		AuthProtocol: x11AuthProtocol,
+		AuthCookie:   hex.EncodeToString(ws.x11Cookie),
+	}
+	ok, err := s.SendRequest("x11-req", true, ssh.Marshal(&req))
+	if err == nil && !ok {
+		err = errors.New("x11 forwarding refused")
+	}
+	return errors.Wrap(err, "x11 forwarding")
+}
+
+// pendX11 keep the connection of an authorized x11 client until the browser
+// attaches to it, telling the browser its random id
+func (ws *WebSSH) pendX11(ch ssh.Channel) {
+	//a client sending nothing must not hold the channel forever
+	deadline := time.AfterFunc(X11Wait, func() { ch.Close() })
+	setup, err := readX11Setup(ch, ws.x11Cookie)
+	if !deadline.Stop() {
+		err = errors.New("x11 setup timed out")
+	}
+	if err != nil {
+		ws.logger.Printf("x11 connection rejected %s", err)
+		ch.Close()
+		return
+	}
+	b := make([]byte, 24)
+	if _, err = rand.Read(b); err != nil {
+		ws.logger.Printf("x11 id failed %s", err)
+		ch.Close()
+		return
+	}
+	id := hex.EncodeToString(b)
+
+	ws.xmu.Lock()
+	if ws.x11Pending == nil {
+		ws.x11Pending = make(map[string]*x11Channel)
+	}
+	x := &x11Channel{ch: ch, setup: setup}
+	x.timer = time.AfterFunc(X11Wait, func() {
+		if ws.takeX11(id) != nil {
+			ws.logger.Printf("x11 connection not attached in time")
+			ch.Close()
+		}
+	})
+	ws.x11Pending[id] = x
+	x11Mu.Lock()
+	x11Owners[id] = ws
+	x11Mu.Unlock()
+	ws.xmu.Unlock()
+
+	ws.writeJSON(&message{Type: messageTypeX11, Data: []byte(id)})
+}
+
+func (ws *WebSSH) takeX11(id string) *x11Channel {
+	x11Mu.Lock()
+	if x11Owners[id] == ws {
+		delete(x11Owners, id)
+	}
+	x11Mu.Unlock()
+	ws.xmu.Lock()
+	defer ws.xmu.Unlock()
+	x := ws.x11Pending[id]
+	delete(ws.x11Pending, id)
+	return x
+}
+
+func (ws *WebSSH) closeX11() {
+	ws.xmu.Lock()
+	pending := ws.x11Pending
+	ws.x11Pending = nil
+	ws.xmu.Unlock()
+	x11Mu.Lock()
+	for id := range pending {
+		delete(x11Owners, id)
+	}
+	x11Mu.Unlock()
+	for _, x := range pending {
+		x.timer.Stop()
+		x.ch.Close()
+	}
+}
+
+// AttachX11 carry the x11 connection id of the session over conn, as binary
+// messages starting with the connection setup of the x11 client
+func (ws *WebSSH) AttachX11(conn *websocket.Conn, id string, tracked *common.Session) error {
+	x := ws.takeX11(id)
+	if x == nil {
+		return errors.New("x11 connection not found")
+	}
+	x.timer.Stop()
+	ws.logger.Printf("x11 connection %s attached from %s", tracked.ID, conn.RemoteAddr())
+	go func() {
+		defer tracked.Done()
+		proxyX11(ws, conn, x, tracked)
+	}()
+	return nil
+}
+
+func proxyX11(ws *WebSSH, conn *websocket.Conn, x *x11Channel, tracked *common.Session) {
+	ch := make(chan struct{}, 1)
+	defer x.ch.Close()
+	defer close(ch)
+	go func() {
+		if ok := common.KeepAlive(conn, ch, ws.logger); !ok {
+			conn.Close()
+		}
+	}()
+
+	tracked.Output(len(x.setup))
+	if err := conn.WriteMessage(websocket.BinaryMessage, x.setup); err != nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		defer conn.Close()
+		buff := make([]byte, 32*1024)
+		for {
+			n, err := x.ch.Read(buff)
+			if err != nil {
+				common.Shutdown(conn, "x11 closed")
+				return
+			}
+			tracked.Output(n)
+			if err = conn.WriteMessage(websocket.BinaryMessage, buff[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			ws.logger.Printf("x11 websocket read failed %s", err)
+			return
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		tracked.Input(len(data))
+		if _, err = x.ch.Write(data); err != nil {
+			ws.logger.Printf("x11 write failed %s", err)
+			return
+		}
+	}
+}
+
+// readX11Setup read the connection setup of an x11 client, check its cookie
+// and return the setup without authorization, as the browser x server has none
+func readX11Setup(r io.Reader, cookie []byte) ([]byte, error) {
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.Wrap(err, "x11 setup")
+	}
+	var order binary.ByteOrder
+	switch head[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, errors.Errorf("x11 byte order %#x invalid", head[0])
+	}
+	pad := func(n int) int { return (n + 3) &^ 3 }
+	nameLen := int(order.Uint16(head[6:]))
+	dataLen := int(order.Uint16(head[8:]))
+	auth := make([]byte, pad(nameLen)+pad(dataLen))
+	if _, err := io.ReadFull(r, auth); err != nil {
+		return nil, errors.Wrap(err, "x11 setup")
+	}
+	name := auth[:nameLen]
+	data := auth[pad(nameLen) : pad(nameLen)+dataLen]
+	if string(name) != x11AuthProtocol || subtle.ConstantTimeCompare(data, cookie) != 1 {
+		return nil, errors.New("x11 authorization invalid")
+	}
+	order.PutUint16(head[6:], 0)
+	order.PutUint16(head[8:], 0)
+	return head, nil
+}
@@ -0,0 +1,135 @@
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// rfb client to server message types
+const (
+	clientSetPixelFormat           = 0
+	clientSetEncodings             = 2
+	clientFramebufferUpdateRequest = 3
+	clientKeyEvent                 = 4
+	clientPointerEvent             = 5
+	clientCutText                  = 6
+	clientEnableContinuousUpdates  = 150
+	clientFence                    = 248
+	clientSetDesktopSize           = 251
+	clientXvp                      = 250
+	clientQEMU                     = 255
+)
+
+// longest ClientCutText accepted, larger ones are dropped while read
+const maxCutText = 16 * 1024 * 1024
+
+// viewOnlyDropped are the messages acting on the desktop
+var viewOnlyDropped = map[byte]bool{
+	clientKeyEvent:       true,
+	clientPointerEvent:   true,
+	clientCutText:        true,
+	clientSetDesktopSize: true,
+	clientXvp:            true,
+	clientQEMU:           true,
+}
+
+// userInput are the messages typed, pointed or pasted by the user
+var userInput = map[byte]bool{
+	clientKeyEvent:     true,
+	clientPointerEvent: true,
+	clientCutText:      true,
+}
+
+// readClientMessage read a whole message sent by the browser after the
+// ClientInit, unknown types fail as the rest of the stream can not be framed
+func readClientMessage(r *bufio.Reader) ([]byte, error) {
+	t, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var size int
+	switch t[0] {
+	case clientSetPixelFormat:
+		size = 20
+	case clientSetEncodings:
+		h, err := r.Peek(4)
+		if err != nil {
+			return nil, err
+		}
+		size = 4 + 4*int(binary.BigEndian.Uint16(h[2:]))
+	case clientFramebufferUpdateRequest, clientEnableContinuousUpdates:
+		size = 10
+	case clientKeyEvent:
+		size = 8
+	case clientPointerEvent:
+		size = 6
+	case clientXvp:
+		size = 4
+	case clientCutText:
+		h, err := r.Peek(8)
+		if err != nil {
+			return nil, err
+		}
+		//negative for the extended clipboard
+		n := int64(int32(binary.BigEndian.Uint32(h[4:])))
+		if n < 0 {
+			n = -n
+		}
+		if n > maxCutText {
+			return nil, fmt.Errorf("cut text of %d bytes too long", n)
+		}
+		size = 8 + int(n)
+	case clientFence:
+		h, err := r.Peek(9)
+		if err != nil {
+			return nil, err
+		}
+		size = 9 + int(h[8])
+	case clientSetDesktopSize:
+		h, err := r.Peek(8)
+		if err != nil {
+			return nil, err
+		}
+		size = 8 + 16*int(h[6])
+	case clientQEMU:
+		h, err := r.Peek(4)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		//extended key event
+		case h[1] == 0:
+			size = 12
+		//audio
+		case h[1] == 1 && binary.BigEndian.Uint16(h[2:]) == 2:
+			size = 10
+		case h[1] == 1:
+			size = 4
+		default:
+			return nil, fmt.Errorf("rfb qemu message %d unknown", h[1])
+		}
+	default:
+		return nil, fmt.Errorf("rfb client message %d unknown", t[0])
+	}
+	msg := make([]byte, size)
+	_, err = io.ReadFull(r, msg)
+	return msg, err
+}
+
+// filterEncodings drop from a SetEncodings the extended clipboard, whose
+// texts are not inspected, and when framed the encodings serverReader can not
+// frame
+func filterEncodings(msg []byte, framed bool) []byte {
+	out := append([]byte{}, msg[:4]...)
+	for i := 4; i+4 <= len(msg); i += 4 {
+		e := int32(binary.BigEndian.Uint32(msg[i:]))
+		if e == encodingExtendedClipboard || framed && !framedEncoding(e) {
+			continue
+		}
+		out = append(out, msg[i:i+4]...)
+	}
+	binary.BigEndian.PutUint16(out[2:], uint16((len(out)-4)/4))
+	return out
+}
@@ -0,0 +1,101 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func setEncodings(encodings ...int32) []byte {
+	msg := []byte{clientSetEncodings, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(encodings)))
+	for _, e := range encodings {
+		msg = append(msg, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(msg[len(msg)-4:], uint32(e))
+	}
+	return msg
+}
+
+func TestReadClientMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		err  bool
+	}{
+		{"set pixel format", append([]byte{clientSetPixelFormat}, make([]byte, 19)...), false},
+		{"set encodings", setEncodings(encodingRaw, encodingTight, encodingCursor), false},
+		{"set encodings empty", setEncodings(), false},
+		{"update request", []byte{clientFramebufferUpdateRequest, 1, 0, 0, 0, 0, 0, 32, 0, 32}, false},
+		{"continuous updates", []byte{clientEnableContinuousUpdates, 1, 0, 0, 0, 0, 0, 32, 0, 32}, false},
+		{"key", []byte{clientKeyEvent, 1, 0, 0, 0, 0, 0, 'a'}, false},
+		{"pointer", []byte{clientPointerEvent, 1, 0, 10, 0, 20}, false},
+		{"xvp", []byte{clientXvp, 0, 1, 2}, false},
+		{"cut text", []byte{clientCutText, 0, 0, 0, 0, 0, 0, 3, 'a', 'b', 'c'}, false},
+		{"extended cut text", []byte{clientCutText, 0, 0, 0, 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 1}, false},
+		{"fence", []byte{clientFence, 0, 0, 0, 0, 0, 0, 0, 2, 'x', 'y'}, false},
+		{"set desktop size", append([]byte{clientSetDesktopSize, 0, 0, 32, 0, 32, 1, 0}, make([]byte, 16)...), false},
+		{"qemu extended key", []byte{clientQEMU, 0, 0, 1, 0, 0, 0, 'a', 0, 0, 0, 30}, false},
+		{"qemu audio data", []byte{clientQEMU, 1, 0, 2, 0, 0, 0, 0, 0, 0}, false},
+		{"qemu audio enable", []byte{clientQEMU, 1, 0, 0}, false},
+		{"qemu unknown", []byte{clientQEMU, 9, 0, 0}, true},
+		{"unknown", []byte{7, 0, 0, 0}, true},
+		{"cut text too long", []byte{clientCutText, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//a trailing message must be left unread
+			next := []byte{clientKeyEvent, 0, 0, 0, 0, 0, 0, 'z'}
+			r := bufio.NewReader(bytes.NewReader(append(append([]byte{}, tt.msg...), next...)))
+			msg, err := readClientMessage(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("read %x, want error", msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, tt.msg) {
+				t.Fatalf("read %x, want %x", msg, tt.msg)
+			}
+			if msg, err = readClientMessage(r); err != nil || !bytes.Equal(msg, next) {
+				t.Fatalf("next read %x %v, want %x", msg, err, next)
+			}
+		})
+	}
+}
+
+func TestReadClientMessageShort(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{clientKeyEvent, 1, 0}))
+	if _, err := readClientMessage(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestFilterEncodings(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []int32
+		framed bool
+		out    []int32
+	}{
+		{"keep", []int32{encodingTight, encodingRaw, encodingCursor}, false, []int32{encodingTight, encodingRaw, encodingCursor}},
+		{"extended clipboard", []int32{encodingRaw, encodingExtendedClipboard, encodingCopyRect}, false, []int32{encodingRaw, encodingCopyRect}},
+		{"unframed kept", []int32{encodingRaw, -260, 21}, false, []int32{encodingRaw, -260, 21}},
+		{"unframed dropped", []int32{-260, encodingZRLE, 21, encodingExtendedClipboard, encodingHextile}, true, []int32{encodingZRLE, encodingHextile}},
+		{"quality hints", []int32{encodingTight, -26, -250, -500, -765}, true, []int32{encodingTight, -26, -250, -500, -765}},
+		{"pseudo encodings", []int32{encodingDesktopSize, encodingLastRect, encodingExtendedDesktopSize, encodingFence}, true, []int32{encodingDesktopSize, encodingLastRect, encodingExtendedDesktopSize, encodingFence}},
+		{"none left", []int32{encodingExtendedClipboard}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterEncodings(setEncodings(tt.in...), tt.framed)
+			if want := setEncodings(tt.out...); !bytes.Equal(got, want) {
+				t.Fatalf("got %x, want %x", got, want)
+			}
+		})
+	}
+}
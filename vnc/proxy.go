@@ -1,6 +1,11 @@
 package vnc
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
 	"net"
 
@@ -8,8 +13,99 @@ import (
 	"github.com/myml/webssh/common"
 )
 
-func Proxy(logger *log.Logger, ws *websocket.Conn, conn net.Conn) {
+// Options of a proxied vnc session
+type Options struct {
+	//the server has been authenticated by ServerAuth, present the None
+	//security type to the browser
+	Authenticated bool
+	//drop the input of the browser
+	ViewOnly bool
+	//copy and paste policy, nil passes all texts on
+	Clipboard *common.ClipboardConfig
+}
+
+// filtered report whether the messages are filtered, which requires the
+// handshake to be done or relayed by the proxy
+func (o *Options) filtered() bool {
+	return o.ViewOnly || o.clipboard(common.ClipboardUpload) || o.clipboard(common.ClipboardDownload)
+}
+
+// clipboard report whether the texts copied in direction dir are subject to
+// the clipboard policy
+func (o *Options) clipboard(dir string) bool {
+	return o.Clipboard != nil && o.Clipboard.Rule(dir).Restricted()
+}
+
+// stream reads and writes rfb over the messages of a websocket
+type stream struct {
+	ws     *websocket.Conn
+	b64    bool
+	logger *log.Logger
+	s      *common.Session
+	buf    []byte
+	//records what the browser receives
+	rec *recorder
+}
+
+func (st *stream) Read(p []byte) (int, error) {
+	for len(st.buf) == 0 {
+		msgType, msg, err := common.ReadMessageWithIdleTime(st.ws, st.logger)
+		if err != nil {
+			return 0, err
+		}
+		if st.b64 {
+			if msg, err = base64.StdEncoding.DecodeString(string(msg)); err != nil {
+				return 0, err
+			}
+		} else if msgType != websocket.BinaryMessage {
+			st.logger.Printf("Non binary message recieved")
+		}
+		//only the events are user input, see filterClient
+		st.s.Received(len(msg))
+		st.buf = msg
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	return n, nil
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	st.s.Output(len(p))
+	if st.rec != nil {
+		if err := st.rec.write(p); err != nil {
+			st.s.Close("recording failed")
+			return 0, err
+		}
+	}
+	var err error
+	if st.b64 {
+		err = st.ws.WriteMessage(websocket.TextMessage, []byte(base64.StdEncoding.EncodeToString(p)))
+	} else {
+		err = st.ws.WriteMessage(websocket.BinaryMessage, p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func Proxy(logger *log.Logger, ws *websocket.Conn, conn net.Conn, s *common.Session, opts *Options) {
 	logger.Printf("vnc start working %s->%s", ws.RemoteAddr().String(), conn.RemoteAddr().String())
+	st := &stream{ws: ws, b64: ws.Subprotocol() == ProtocolBase64, logger: logger, s: s}
+	if RecordDir != "" {
+		name := recordName(s.Start.Format("20060102-150405"), common.TokenHash(s.Token), s.ID)
+		rec, err := newRecorder(logger, RecordDir, name)
+		if err != nil {
+			//sessions to be recorded must not go unrecorded
+			logger.Printf("vnc recording failed %s", err)
+			s.Close("recording failed")
+			ws.Close()
+			conn.Close()
+			return
+		}
+		defer rec.close()
+		st.rec = rec
+	}
 
 	ch := make(chan struct{}, 1)
 	defer conn.Close()
@@ -20,8 +116,27 @@ func Proxy(logger *log.Logger, ws *websocket.Conn, conn net.Conn) {
 		}
 	}()
 
+	if opts.Authenticated {
+		if err := clientNone(st); err != nil {
+			logger.Printf("vnc client handshake failed %s", err.Error())
+			return
+		}
+	} else if opts.filtered() {
+		if err := relayAuth(conn, st); err != nil {
+			logger.Printf("vnc handshake relay failed %s", err.Error())
+			return
+		}
+	}
+
+	pf := &pixelFormat{}
 	go func() {
 		defer ws.Close()
+		if opts.clipboard(common.ClipboardDownload) {
+			if err := filterServer(logger, conn, st, pf, opts); err != nil {
+				logger.Printf("vnc server stream ended %s", err.Error())
+			}
+			return
+		}
 		for {
 			buffer := make([]byte, 1024)
 			n, err := conn.Read(buffer)
@@ -29,23 +144,143 @@ func Proxy(logger *log.Logger, ws *websocket.Conn, conn net.Conn) {
 				logger.Printf("tcp conn read failed %s", err.Error())
 				return
 			}
-			ws.WriteMessage(websocket.BinaryMessage, buffer[:n])
+			if _, err = st.Write(buffer[:n]); err != nil {
+				logger.Printf("websocket write failed %s", err.Error())
+				return
+			}
 		}
 	}()
+	if opts.Authenticated || opts.filtered() {
+		if err := filterClient(logger, st, conn, s, pf, opts); err != nil {
+			logger.Printf("vnc client stream ended %s", err.Error())
+		}
+		return
+	}
+	buffer := make([]byte, 32*1024)
 	for {
-		msgType, msg, err := common.ReadMessageWithIdleTime(ws, logger)
-
+		n, err := st.Read(buffer)
 		if err != nil {
 			logger.Printf("websocket read failed %s", err.Error())
 			return
 		}
-		if msgType != websocket.BinaryMessage {
-			logger.Printf("Non binary message recieved")
-		}
-		_, err = conn.Write(msg)
+		//the handshake of the browser is not parsed, any message counts as input
+		s.Touch()
+		_, err = conn.Write(buffer[:n])
 		if err != nil {
 			logger.Printf("tcp conn write failed %s", err.Error())
 			return
 		}
 	}
 }
+
+// filterClient forward the messages of the browser allowed by opts, the
+// events forwarded set the last input time of s
+func filterClient(logger *log.Logger, st io.Reader, conn net.Conn, s *common.Session, pf *pixelFormat, opts *Options) error {
+	r := bufio.NewReaderSize(st, 32*1024)
+	shared, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	//watching must not disconnect the other clients of the desktop
+	if opts.ViewOnly {
+		shared = 1
+	}
+	if _, err = conn.Write([]byte{shared}); err != nil {
+		return err
+	}
+	clipboard := opts.clipboard(common.ClipboardUpload) || opts.clipboard(common.ClipboardDownload)
+	for {
+		msg, err := readClientMessage(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case opts.ViewOnly && viewOnlyDropped[msg[0]]:
+			continue
+		case msg[0] == clientSetPixelFormat:
+			pf.change(msg[4:])
+		case msg[0] == clientSetEncodings && clipboard:
+			msg = filterEncodings(msg, opts.clipboard(common.ClipboardDownload))
+		case msg[0] == clientCutText && opts.clipboard(common.ClipboardUpload):
+			if msg = cutText(logger, opts.Clipboard, common.ClipboardUpload, msg); msg == nil {
+				continue
+			}
+		}
+		if userInput[msg[0]] {
+			s.Touch()
+		}
+		if _, err = conn.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// filterServer forward the messages of the server, applying the clipboard
+// policy to its cut texts
+func filterServer(logger *log.Logger, conn net.Conn, st io.Writer, pf *pixelFormat, opts *Options) error {
+	sr := &serverReader{r: bufio.NewReaderSize(conn, 32*1024), w: bufio.NewWriterSize(st, 32*1024), pf: pf}
+	if err := sr.serverInit(); err != nil {
+		return err
+	}
+	for {
+		//batch what the server has already sent into fewer websocket messages
+		if sr.r.Buffered() == 0 {
+			if err := sr.w.Flush(); err != nil {
+				return err
+			}
+		}
+		t, err := sr.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if t != serverCutText {
+			if err = sr.w.WriteByte(t); err != nil {
+				return err
+			}
+			if err = sr.copyMessage(t); err != nil {
+				return err
+			}
+			continue
+		}
+		h := []byte{t, 0, 0, 0, 0, 0, 0, 0}
+		if _, err = io.ReadFull(sr.r, h[1:]); err != nil {
+			return err
+		}
+		n := int64(int32(binary.BigEndian.Uint32(h[4:])))
+		if n < 0 {
+			n = -n
+		}
+		if n > maxCutText {
+			return fmt.Errorf("cut text of %d bytes too long", n)
+		}
+		msg := make([]byte, 8+n)
+		copy(msg, h)
+		if _, err = io.ReadFull(sr.r, msg[8:]); err != nil {
+			return err
+		}
+		if msg = cutText(logger, opts.Clipboard, common.ClipboardDownload, msg); msg != nil {
+			if _, err = sr.w.Write(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// cutText apply the clipboard policy of dir to a Client or ServerCutText,
+// return the message to forward, nil to drop it
+func cutText(logger *log.Logger, c *common.ClipboardConfig, dir string, msg []byte) []byte {
+	//the extended clipboard is kept from being negotiated by filterEncodings
+	if int32(binary.BigEndian.Uint32(msg[4:])) < 0 {
+		logger.Printf("vnc extended clipboard %s dropped", dir)
+		return nil
+	}
+	text, ok := c.Apply(logger, "vnc", dir, msg[8:], true)
+	if !ok {
+		return nil
+	}
+	out := make([]byte, 8+len(text))
+	out[0] = msg[0]
+	binary.BigEndian.PutUint32(out[4:], uint32(len(text)))
+	copy(out[8:], text)
+	return out
+}
@@ -0,0 +1,138 @@
+package vnc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//when set, vnc sessions are recorded into the dir for noVNC playback
+	RecordDir string
+	//bytes of a recording file before the next one of the session is started
+	RecordMaxSize int64 = 64 * 1024 * 1024
+	//files a session may fill, the session is closed once the last is full
+	RecordMaxFiles = 16
+)
+
+// a noVNC VNC_frame_data script, each frame is '{<ms>{<base64>' for data sent
+// to the browser
+const (
+	recordHeader = "var VNC_frame_encoding = 'base64';\nvar VNC_frame_data = [\n"
+	recordFooter = "'EOF'];\n"
+)
+
+// recorder writes what the browser receives into numbered noVNC recording
+// files, the ones after the first continue the stream of the previous
+type recorder struct {
+	mu     sync.Mutex
+	logger *log.Logger
+	f      *os.File
+	base   string
+	start  time.Time
+	part   int
+	size   int64
+}
+
+func recordName(parts ...string) string {
+	clean := func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}
+	for i, p := range parts {
+		parts[i] = strings.Map(clean, p)
+	}
+	return strings.Join(parts, "-")
+}
+
+func newRecorder(logger *log.Logger, dir, name string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("record dir: %w", err)
+	}
+	r := &recorder{logger: logger, base: filepath.Join(dir, name), start: time.Now()}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open the next file of the session
+func (r *recorder) open() error {
+	r.part++
+	f, err := os.OpenFile(fmt.Sprintf("%s.%d.js", r.base, r.part), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("record file: %w", err)
+	}
+	if _, err = io.WriteString(f, recordHeader); err != nil {
+		f.Close()
+		return fmt.Errorf("record header: %w", err)
+	}
+	r.f = f
+	r.size = int64(len(recordHeader))
+	return nil
+}
+
+// finish the current file, leaving it replayable
+func (r *recorder) finish() error {
+	_, err := io.WriteString(r.f, recordFooter)
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f = nil
+	return err
+}
+
+// write records data sent to the browser, failing once the recording has
+// stopped, as data must not reach the browser unrecorded
+func (r *recorder) write(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return errors.New("recording stopped")
+	}
+
+	ms := time.Since(r.start).Nanoseconds() / int64(time.Millisecond)
+	frame := fmt.Sprintf("'{%d{%s',\n", ms, base64.StdEncoding.EncodeToString(data))
+	//a frame larger than a whole file still goes into one
+	if r.size > int64(len(recordHeader)) && r.size+int64(len(frame)+len(recordFooter)) > RecordMaxSize {
+		err := r.finish()
+		if err == nil && r.part >= RecordMaxFiles {
+			err = errors.New("all files full")
+		}
+		if err == nil {
+			err = r.open()
+		}
+		if err != nil {
+			r.logger.Printf("vnc recording stopped %s", err)
+			return err
+		}
+	}
+	if _, err := io.WriteString(r.f, frame); err != nil {
+		r.logger.Printf("vnc recording stopped %s", err)
+		r.f.Close()
+		r.f = nil
+		return err
+	}
+	r.size += int64(len(frame))
+	return nil
+}
+
+func (r *recorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return
+	}
+	if err := r.finish(); err != nil {
+		r.logger.Printf("vnc recording close failed %s", err)
+	}
+}
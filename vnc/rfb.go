@@ -0,0 +1,511 @@
+package vnc
+
+import (
+	"crypto/des"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// rfb security types
+const (
+	securityInvalid  = 0
+	securityNone     = 1
+	securityVNCAuth  = 2
+	securityVeNCrypt = 19
+)
+
+// VeNCrypt sub types, the anonymous tls ones are not supported by crypto/tls
+const (
+	veNCryptPlain     = 256
+	veNCryptX509None  = 260
+	veNCryptX509VNC   = 261
+	veNCryptX509Plain = 262
+)
+
+// longest reason string read from a server
+const maxReason = 4096
+
+// CAs the VeNCrypt certificates of vnc servers are verified with, nil to
+// trust any certificate. The password is only sent in the x509 plain sub type
+// when it is set
+var RootCAs *x509.CertPool
+
+// LoadRootCAs set RootCAs to the pem certificates of file
+func LoadRootCAs(file string) error {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("load vnc ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("load vnc ca: no certificate found")
+	}
+	RootCAs = pool
+	return nil
+}
+
+// VeNCrypt offers no sub type as safe as VncAuth, offered too by the server
+var errVeNCryptWeak = errors.New("VeNCrypt sub types weaker than VncAuth")
+
+// ServerAuth negotiate the rfb version and security with the vnc server of
+// conn, authenticating with user and password, and return the connection to
+// go on with once authenticated, ready for the ClientInit of the browser.
+// conn is closed on failure. A server offering VeNCrypt with no sub type as safe
+// as VncAuth is dialed again by redial to pick VncAuth
+func ServerAuth(conn net.Conn, redial func() (net.Conn, error), user, password string, timeout time.Duration) (net.Conn, error) {
+	c, err := serverAuth(conn, user, password, timeout, true)
+	if err == errVeNCryptWeak {
+		conn.Close()
+		if conn, err = redial(); err != nil {
+			return nil, err
+		}
+		c, err = serverAuth(conn, user, password, timeout, false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func serverAuth(conn net.Conn, user, password string, timeout time.Duration, veNCrypt bool) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	version, err := readVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	if version > 8 {
+		version = 8
+	}
+	if _, err = fmt.Fprintf(conn, "RFB 003.%03d\n", version); err != nil {
+		return nil, err
+	}
+
+	var types []byte
+	if version < 7 {
+		var t uint32
+		if err = binary.Read(conn, binary.BigEndian, &t); err != nil {
+			return nil, err
+		}
+		types = []byte{byte(t)}
+	} else {
+		var n uint8
+		if err = binary.Read(conn, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		types = make([]byte, n)
+		if _, err = io.ReadFull(conn, types); err != nil {
+			return nil, err
+		}
+	}
+	if len(types) == 0 || types[0] == securityInvalid {
+		return nil, readReason(conn, "connection refused")
+	}
+
+	security, err := selectSecurity(types, password != "", veNCrypt)
+	if err != nil {
+		return nil, err
+	}
+	if version >= 7 {
+		if _, err = conn.Write([]byte{security}); err != nil {
+			return nil, err
+		}
+	}
+	switch security {
+	case securityNone:
+		if version < 8 {
+			return conn, nil
+		}
+	case securityVNCAuth:
+		if err = vncAuth(conn, password); err != nil {
+			return nil, err
+		}
+	case securityVeNCrypt:
+		if conn, err = veNCryptAuth(conn, user, password, hasType(types, securityVNCAuth)); err != nil {
+			return nil, err
+		}
+	}
+	return conn, securityResult(conn, version)
+}
+
+// readVersion read the ProtocolVersion of the peer, return its minor version
+func readVersion(r io.Reader) (int, error) {
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(b), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return 0, fmt.Errorf("rfb version %q invalid", b)
+	}
+	if minor < 3 {
+		return 0, fmt.Errorf("rfb version %q not supported", b)
+	}
+	//3.4 and 3.6 are sent by some clients for 3.3
+	if minor < 7 {
+		minor = 3
+	}
+	return minor, nil
+}
+
+// selectSecurity pick the strongest type offered that can be served
+func selectSecurity(types []byte, password, veNCrypt bool) (byte, error) {
+	prefer := []byte{securityNone}
+	if password && veNCrypt {
+		prefer = []byte{securityVeNCrypt, securityVNCAuth, securityNone}
+	} else if password {
+		prefer = []byte{securityVNCAuth, securityNone}
+	}
+	for _, p := range prefer {
+		if hasType(types, p) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("rfb security types %v not supported", types)
+}
+
+func hasType(types []byte, t byte) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func readReason(r io.Reader, def string) error {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil || n == 0 || n > maxReason {
+		return errors.New(def)
+	}
+	reason := make([]byte, n)
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return errors.New(def)
+	}
+	return fmt.Errorf("%s: %s", def, reason)
+}
+
+func securityResult(r io.Reader, version int) error {
+	var result uint32
+	if err := binary.Read(r, binary.BigEndian, &result); err != nil {
+		return err
+	}
+	if result == 0 {
+		return nil
+	}
+	if version >= 8 {
+		return readReason(r, "vnc authentication failed")
+	}
+	return errors.New("vnc authentication failed")
+}
+
+// vncAuth answer the challenge of the server with the password as DES key
+func vncAuth(rw io.ReadWriter, password string) error {
+	challenge := make([]byte, 16)
+	if _, err := io.ReadFull(rw, challenge); err != nil {
+		return err
+	}
+	//the key is the password padded to 8 bytes, each byte bit reversed
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		b = b>>4&0x0f | b<<4&0xf0
+		b = b>>2&0x33 | b<<2&0xcc
+		b = b>>1&0x55 | b<<1&0xaa
+		key[i] = b
+	}
+	cipher, err := des.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	cipher.Encrypt(challenge[:8], challenge[:8])
+	cipher.Encrypt(challenge[8:], challenge[8:])
+	_, err = rw.Write(challenge)
+	return err
+}
+
+// veNCryptAuth negotiate a VeNCrypt 0.2 sub type, return conn wrapped by tls
+// for the x509 sub types. The sub types sending the password unverified are
+// refused with errVeNCryptWeak when the server offers VncAuth too
+func veNCryptAuth(conn net.Conn, user, password string, vncAuthOffered bool) (net.Conn, error) {
+	var version [2]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return nil, err
+	}
+	if version[0] != 0 || version[1] < 2 {
+		return nil, fmt.Errorf("VeNCrypt version %d.%d not supported", version[0], version[1])
+	}
+	if _, err := conn.Write([]byte{0, 2}); err != nil {
+		return nil, err
+	}
+	var ack, n uint8
+	if err := binary.Read(conn, binary.BigEndian, &ack); err != nil {
+		return nil, err
+	}
+	if ack != 0 {
+		return nil, errors.New("VeNCrypt version refused")
+	}
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	subtypes := make([]uint32, n)
+	if err := binary.Read(conn, binary.BigEndian, subtypes); err != nil {
+		return nil, err
+	}
+
+	subtype := selectSubtype(subtypes, RootCAs != nil, vncAuthOffered)
+	if subtype == 0 {
+		if vncAuthOffered {
+			return nil, errVeNCryptWeak
+		}
+		return nil, fmt.Errorf("VeNCrypt sub types %v not supported", subtypes)
+	}
+	if err := binary.Write(conn, binary.BigEndian, subtype); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(conn, binary.BigEndian, &ack); err != nil {
+		return nil, err
+	}
+	if ack != 1 {
+		return nil, fmt.Errorf("VeNCrypt sub type %d refused", subtype)
+	}
+
+	if subtype != veNCryptPlain {
+		//vms present self signed certificates, the link to them is trusted
+		//as much as the plain tcp connection unless the CAs are pinned
+		config := &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}
+		if RootCAs != nil {
+			config.VerifyPeerCertificate = verifyChain
+		}
+		c := tls.Client(conn, config)
+		if err := c.Handshake(); err != nil {
+			return nil, fmt.Errorf("VeNCrypt tls: %w", err)
+		}
+		conn = c
+	}
+	switch subtype {
+	case veNCryptX509VNC:
+		return conn, vncAuth(conn, password)
+	case veNCryptPlain, veNCryptX509Plain:
+		b := make([]byte, 8, 8+len(user)+len(password))
+		binary.BigEndian.PutUint32(b, uint32(len(user)))
+		binary.BigEndian.PutUint32(b[4:], uint32(len(password)))
+		b = append(append(b, user...), password...)
+		_, err := conn.Write(b)
+		return conn, err
+	}
+	return conn, nil
+}
+
+// selectSubtype pick the VeNCrypt sub type to use, 0 if none is acceptable.
+// The password is only sent in plain over tls verified by the pinned CAs, or
+// as a last resort when the server offers nothing else
+func selectSubtype(subtypes []uint32, verified, vncAuthOffered bool) uint32 {
+	prefer := []uint32{veNCryptX509VNC}
+	if verified {
+		prefer = append(prefer, veNCryptX509Plain)
+	}
+	prefer = append(prefer, veNCryptX509None)
+	if !vncAuthOffered {
+		prefer = append(prefer, veNCryptX509Plain, veNCryptPlain)
+	}
+	for _, p := range prefer {
+		for _, t := range subtypes {
+			if t == p {
+				return p
+			}
+		}
+	}
+	return 0
+}
+
+// verifyChain verify the certificate of the vnc server against RootCAs, any
+// host name goes as vms are dialed by ip
+func verifyChain(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("VeNCrypt certificate missing")
+	}
+	opts := x509.VerifyOptions{Roots: RootCAs, Intermediates: x509.NewCertPool()}
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(opts)
+	return err
+}
+
+// clientNone present the None security type to the browser over rw, which
+// has already been authorized by its token
+func clientNone(rw io.ReadWriter) error {
+	if _, err := io.WriteString(rw, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	version, err := readVersion(rw)
+	if err != nil {
+		return err
+	}
+	if version < 7 {
+		return binary.Write(rw, binary.BigEndian, uint32(securityNone))
+	}
+	if _, err = rw.Write([]byte{1, securityNone}); err != nil {
+		return err
+	}
+	var security uint8
+	if err = binary.Read(rw, binary.BigEndian, &security); err != nil {
+		return err
+	}
+	if security != securityNone {
+		return fmt.Errorf("rfb security type %d chosen by the client invalid", security)
+	}
+	if version < 8 {
+		return nil
+	}
+	return binary.Write(rw, binary.BigEndian, uint32(0))
+}
+
+// relayAuth relay the handshake between the server conn and the browser rw,
+// offering the browser the None and VncAuth types only so that the messages
+// can be filtered once authenticated. The browser answers the VncAuth
+// challenge of the server with the password typed by the user
+func relayAuth(conn net.Conn, rw io.ReadWriter) error {
+	version, err := readVersion(conn)
+	if err != nil {
+		return err
+	}
+	if version > 8 {
+		version = 8
+	}
+	if _, err = fmt.Fprintf(rw, "RFB 003.%03d\n", version); err != nil {
+		return err
+	}
+	client, err := readVersion(rw)
+	if err != nil {
+		return err
+	}
+	if client < version {
+		version = client
+	}
+	if _, err = fmt.Fprintf(conn, "RFB 003.%03d\n", version); err != nil {
+		return err
+	}
+
+	var types []byte
+	if version < 7 {
+		var t uint32
+		if err = binary.Read(conn, binary.BigEndian, &t); err != nil {
+			return err
+		}
+		types = []byte{byte(t)}
+	} else {
+		var n uint8
+		if err = binary.Read(conn, binary.BigEndian, &n); err != nil {
+			return err
+		}
+		types = make([]byte, n)
+		if _, err = io.ReadFull(conn, types); err != nil {
+			return err
+		}
+	}
+	if len(types) == 0 || types[0] == securityInvalid {
+		err = readReason(conn, "connection refused")
+		refuse(rw, version, err.Error())
+		return err
+	}
+	var offered []byte
+	for _, t := range []byte{securityNone, securityVNCAuth} {
+		if hasType(types, t) {
+			offered = append(offered, t)
+		}
+	}
+	if len(offered) == 0 {
+		err = fmt.Errorf("rfb security types %v not supported, vnc_password required by the clipboard or view only policy", types)
+		refuse(rw, version, err.Error())
+		return err
+	}
+
+	security := offered[0]
+	if version < 7 {
+		if err = binary.Write(rw, binary.BigEndian, uint32(security)); err != nil {
+			return err
+		}
+	} else {
+		if _, err = rw.Write(append([]byte{byte(len(offered))}, offered...)); err != nil {
+			return err
+		}
+		if err = binary.Read(rw, binary.BigEndian, &security); err != nil {
+			return err
+		}
+		if !hasType(offered, security) {
+			return fmt.Errorf("rfb security type %d chosen by the client invalid", security)
+		}
+		if _, err = conn.Write([]byte{security}); err != nil {
+			return err
+		}
+	}
+	if security == securityNone && version < 8 {
+		return nil
+	}
+	if security == securityVNCAuth {
+		challenge := make([]byte, 16)
+		if _, err = io.ReadFull(conn, challenge); err != nil {
+			return err
+		}
+		if _, err = rw.Write(challenge); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(rw, challenge); err != nil {
+			return err
+		}
+		if _, err = conn.Write(challenge); err != nil {
+			return err
+		}
+	}
+	if err = securityResult(conn, version); err != nil {
+		//the browser is told the result as the server sent it
+		binary.Write(rw, binary.BigEndian, uint32(1))
+		if version >= 8 {
+			writeReason(rw, err.Error())
+		}
+		return err
+	}
+	return binary.Write(rw, binary.BigEndian, uint32(0))
+}
+
+// refuse the connection of the browser with reason
+func refuse(w io.Writer, version int, reason string) error {
+	var err error
+	if version < 7 {
+		err = binary.Write(w, binary.BigEndian, uint32(securityInvalid))
+	} else {
+		_, err = w.Write([]byte{0})
+	}
+	if err != nil {
+		return err
+	}
+	return writeReason(w, reason)
+}
+
+func writeReason(w io.Writer, reason string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(reason))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, reason)
+	return err
+}
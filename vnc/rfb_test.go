@@ -0,0 +1,143 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayAuth(t *testing.T) {
+	challenge := []byte("challenge-012345")
+	response := []byte("response-0123456")
+	tests := []struct {
+		name    string
+		version string
+		//offered by the server, the one chosen by it before 3.7
+		types  []byte
+		result uint32
+		//offered to the browser, nil when refused
+		offered []byte
+		//chosen by the browser
+		choose byte
+		err    bool
+	}{
+		{"3.8 vnc auth", "RFB 003.008\n", []byte{securityVeNCrypt, securityVNCAuth}, 0, []byte{securityVNCAuth}, securityVNCAuth, false},
+		{"3.8 none", "RFB 003.008\n", []byte{securityNone, 16}, 0, []byte{securityNone}, securityNone, false},
+		{"3.8 none and vnc auth", "RFB 003.008\n", []byte{securityVNCAuth, securityNone}, 0, []byte{securityNone, securityVNCAuth}, securityVNCAuth, false},
+		{"3.8 failed", "RFB 003.008\n", []byte{securityVNCAuth}, 1, []byte{securityVNCAuth}, securityVNCAuth, true},
+		{"3.8 vencrypt only", "RFB 003.008\n", []byte{securityVeNCrypt}, 0, nil, 0, true},
+		{"3.7 none", "RFB 003.007\n", []byte{securityNone}, 0, []byte{securityNone}, securityNone, false},
+		{"3.3 vnc auth", "RFB 003.003\n", []byte{securityVNCAuth}, 0, []byte{securityVNCAuth}, securityVNCAuth, false},
+		{"3.3 failed", "RFB 003.003\n", []byte{securityVNCAuth}, 1, []byte{securityVNCAuth}, securityVNCAuth, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, server := net.Pipe()
+			rw, browser := net.Pipe()
+			deadline := time.Now().Add(2 * time.Second)
+			for _, c := range []net.Conn{conn, server, rw, browser} {
+				c.SetDeadline(deadline)
+				defer c.Close()
+			}
+
+			go func() {
+				defer server.Close()
+				io.WriteString(server, tt.version)
+				minor, err := readVersion(server)
+				if err != nil {
+					return
+				}
+				security := tt.types[0]
+				if minor < 7 {
+					binary.Write(server, binary.BigEndian, uint32(security))
+				} else {
+					server.Write(append([]byte{byte(len(tt.types))}, tt.types...))
+					if err = binary.Read(server, binary.BigEndian, &security); err != nil {
+						return
+					}
+				}
+				if security == securityVNCAuth {
+					server.Write(challenge)
+					b := make([]byte, 16)
+					if _, err = io.ReadFull(server, b); err != nil || !bytes.Equal(b, response) {
+						return
+					}
+				}
+				if security == securityNone && minor < 8 {
+					return
+				}
+				binary.Write(server, binary.BigEndian, tt.result)
+				if tt.result != 0 && minor >= 8 {
+					writeReason(server, "bad password")
+				}
+			}()
+
+			var offered []byte
+			var result uint32
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				minor, err := readVersion(browser)
+				if err != nil {
+					return
+				}
+				io.WriteString(browser, tt.version)
+				if minor < 7 {
+					var t uint32
+					if err = binary.Read(browser, binary.BigEndian, &t); err != nil {
+						return
+					}
+					if t == 0 {
+						readReason(browser, "")
+						return
+					}
+					offered = []byte{byte(t)}
+				} else {
+					var n uint8
+					if err = binary.Read(browser, binary.BigEndian, &n); err != nil {
+						return
+					}
+					if n == 0 {
+						readReason(browser, "")
+						return
+					}
+					offered = make([]byte, n)
+					if _, err = io.ReadFull(browser, offered); err != nil {
+						return
+					}
+					browser.Write([]byte{tt.choose})
+				}
+				if tt.choose == securityVNCAuth {
+					b := make([]byte, 16)
+					if _, err = io.ReadFull(browser, b); err != nil || !bytes.Equal(b, challenge) {
+						return
+					}
+					browser.Write(response)
+				}
+				if tt.choose == securityNone && minor < 8 {
+					return
+				}
+				binary.Read(browser, binary.BigEndian, &result)
+				if result != 0 && minor >= 8 {
+					readReason(browser, "")
+				}
+			}()
+
+			err := relayAuth(conn, rw)
+			if (err != nil) != tt.err {
+				t.Fatalf("err %v", err)
+			}
+			rw.Close()
+			<-done
+			if !bytes.Equal(offered, tt.offered) {
+				t.Fatalf("offered %v, want %v", offered, tt.offered)
+			}
+			if result != tt.result {
+				t.Fatalf("result %d, want %d", result, tt.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// rfb server to client message types
+const (
+	serverFramebufferUpdate      = 0
+	serverSetColourMapEntries    = 1
+	serverBell                   = 2
+	serverCutText                = 3
+	serverEndOfContinuousUpdates = 150
+	serverFence                  = 248
+	serverXvp                    = 250
+	serverQEMU                   = 255
+)
+
+// rfb encodings of the rectangles of a FramebufferUpdate
+const (
+	encodingRaw                 = 0
+	encodingCopyRect            = 1
+	encodingRRE                 = 2
+	encodingHextile             = 5
+	encodingTight               = 7
+	encodingZRLE                = 16
+	encodingCursor              = -239
+	encodingDesktopSize         = -223
+	encodingLastRect            = -224
+	encodingPointerPos          = -232
+	encodingQEMUExtendedKey     = -258
+	encodingQEMUAudio           = -259
+	encodingDesktopName         = -307
+	encodingExtendedDesktopSize = -308
+	encodingXvp                 = -309
+	encodingFence               = -312
+	encodingContinuousUpdates   = -313
+	encodingExtendedClipboard   = -1063131698
+)
+
+// framedEncodings can be framed by serverReader, rectangles of the others
+// have no length to skip them by
+var framedEncodings = map[int32]bool{
+	encodingRaw:                 true,
+	encodingCopyRect:            true,
+	encodingRRE:                 true,
+	encodingHextile:             true,
+	encodingTight:               true,
+	encodingZRLE:                true,
+	encodingCursor:              true,
+	encodingDesktopSize:         true,
+	encodingLastRect:            true,
+	encodingPointerPos:          true,
+	encodingQEMUExtendedKey:     true,
+	encodingQEMUAudio:           true,
+	encodingDesktopName:         true,
+	encodingExtendedDesktopSize: true,
+	encodingXvp:                 true,
+	encodingFence:               true,
+	encodingContinuousUpdates:   true,
+}
+
+// framedEncoding report whether the server sends no rectangle of e or one the
+// serverReader can frame
+func framedEncoding(e int32) bool {
+	switch {
+	//jpeg quality and compression level hints
+	case e >= -32 && e <= -23, e >= -256 && e <= -247:
+		return true
+	//fine quality and subsampling hints
+	case e >= -512 && e <= -412, e >= -768 && e <= -763:
+		return true
+	}
+	return framedEncodings[e]
+}
+
+// pixelFormat of the framebuffer, set by the ServerInit and changed by the
+// SetPixelFormat of the browser
+type pixelFormat struct {
+	mu         sync.Mutex
+	bpp        int
+	depth      int
+	trueColour bool
+	//sent by the browser, applied from the next update on
+	next []byte
+}
+
+// set the pixel format at once
+func (pf *pixelFormat) set(b []byte) {
+	pf.mu.Lock()
+	pf.setLocked(b)
+	pf.mu.Unlock()
+}
+
+func (pf *pixelFormat) setLocked(b []byte) {
+	pf.bpp = int(b[0]) / 8
+	pf.depth = int(b[1])
+	pf.trueColour = b[3] != 0
+}
+
+// change the pixel format from the next FramebufferUpdate on, the update being
+// read may have been encoded before the server got the change
+func (pf *pixelFormat) change(b []byte) {
+	pf.mu.Lock()
+	pf.next = append([]byte(nil), b[:4]...)
+	pf.mu.Unlock()
+}
+
+// update apply the change of the pixel format, at the start of an update
+func (pf *pixelFormat) update() {
+	pf.mu.Lock()
+	if pf.next != nil {
+		pf.setLocked(pf.next)
+		pf.next = nil
+	}
+	pf.mu.Unlock()
+}
+
+// sizes return the bytes of a pixel and of a tight pixel
+func (pf *pixelFormat) sizes() (int, int) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.bpp == 4 && pf.depth == 24 && pf.trueColour {
+		return pf.bpp, 3
+	}
+	return pf.bpp, pf.bpp
+}
+
+// serverReader frame the messages of the vnc server, copying what it reads
+// to w
+type serverReader struct {
+	r  *bufio.Reader
+	w  *bufio.Writer
+	pf *pixelFormat
+}
+
+// next read n bytes and copy them
+func (sr *serverReader) next(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return nil, err
+	}
+	_, err := sr.w.Write(b)
+	return b, err
+}
+
+// skip copy n bytes
+func (sr *serverReader) skip(n int) error {
+	_, err := io.CopyN(sr.w, sr.r, int64(n))
+	return err
+}
+
+// serverInit copy the ServerInit, taking its pixel format
+func (sr *serverReader) serverInit() error {
+	b, err := sr.next(24)
+	if err != nil {
+		return err
+	}
+	sr.pf.set(b[4:])
+	n := binary.BigEndian.Uint32(b[20:])
+	if n > maxReason {
+		return fmt.Errorf("rfb desktop name of %d bytes too long", n)
+	}
+	return sr.skip(int(n))
+}
+
+// copyMessage copy the rest of a message of type t other than ServerCutText
+func (sr *serverReader) copyMessage(t byte) error {
+	switch t {
+	case serverFramebufferUpdate:
+		return sr.framebufferUpdate()
+	case serverSetColourMapEntries:
+		b, err := sr.next(5)
+		if err != nil {
+			return err
+		}
+		return sr.skip(6 * int(binary.BigEndian.Uint16(b[3:])))
+	case serverBell, serverEndOfContinuousUpdates:
+		return nil
+	case serverFence:
+		b, err := sr.next(8)
+		if err != nil {
+			return err
+		}
+		return sr.skip(int(b[7]))
+	case serverXvp:
+		return sr.skip(3)
+	case serverQEMU:
+		b, err := sr.next(3)
+		if err != nil {
+			return err
+		}
+		//audio data, begin and end have no payload
+		if b[0] == 1 && binary.BigEndian.Uint16(b[1:]) == 2 {
+			b, err = sr.next(4)
+			if err != nil {
+				return err
+			}
+			return sr.skip(int(binary.BigEndian.Uint32(b)))
+		}
+		return nil
+	}
+	return fmt.Errorf("rfb server message %d unknown", t)
+}
+
+func (sr *serverReader) framebufferUpdate() error {
+	sr.pf.update()
+	b, err := sr.next(3)
+	if err != nil {
+		return err
+	}
+	//0xffff rectangles are ended by a LastRect
+	for n := int(binary.BigEndian.Uint16(b[1:])); n > 0; n-- {
+		h, err := sr.next(12)
+		if err != nil {
+			return err
+		}
+		w := int(binary.BigEndian.Uint16(h[4:]))
+		ht := int(binary.BigEndian.Uint16(h[6:]))
+		e := int32(binary.BigEndian.Uint32(h[8:]))
+		if e == encodingLastRect {
+			return nil
+		}
+		if err = sr.rect(w, ht, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rect copy the data of a w by h rectangle encoded by e
+func (sr *serverReader) rect(w, h int, e int32) error {
+	bpp, tpixel := sr.pf.sizes()
+	switch e {
+	case encodingRaw:
+		return sr.skip(w * h * bpp)
+	case encodingCopyRect:
+		return sr.skip(4)
+	case encodingRRE:
+		b, err := sr.next(4)
+		if err != nil {
+			return err
+		}
+		return sr.skip(bpp + int(binary.BigEndian.Uint32(b))*(bpp+8))
+	case encodingHextile:
+		return sr.hextile(w, h, bpp)
+	case encodingTight:
+		return sr.tight(w, h, tpixel)
+	case encodingZRLE:
+		b, err := sr.next(4)
+		if err != nil {
+			return err
+		}
+		return sr.skip(int(binary.BigEndian.Uint32(b)))
+	case encodingCursor:
+		return sr.skip(w*h*bpp + (w+7)/8*h)
+	case encodingDesktopName:
+		b, err := sr.next(4)
+		if err != nil {
+			return err
+		}
+		return sr.skip(int(binary.BigEndian.Uint32(b)))
+	case encodingExtendedDesktopSize:
+		b, err := sr.next(4)
+		if err != nil {
+			return err
+		}
+		return sr.skip(16 * int(b[0]))
+	case encodingDesktopSize, encodingPointerPos, encodingQEMUExtendedKey, encodingQEMUAudio,
+		encodingXvp, encodingFence, encodingContinuousUpdates:
+		return nil
+	}
+	return fmt.Errorf("rfb encoding %d can not be framed", e)
+}
+
+// rfb hextile sub encoding flags
+const (
+	hextileRaw              = 1
+	hextileBackground       = 2
+	hextileForeground       = 4
+	hextileAnySubrects      = 8
+	hextileSubrectsColoured = 16
+)
+
+func (sr *serverReader) hextile(w, h, bpp int) error {
+	for y := 0; y < h; y += 16 {
+		for x := 0; x < w; x += 16 {
+			tw, th := min16(w-x), min16(h-y)
+			b, err := sr.next(1)
+			if err != nil {
+				return err
+			}
+			flags := b[0]
+			if flags&hextileRaw != 0 {
+				if err = sr.skip(tw * th * bpp); err != nil {
+					return err
+				}
+				continue
+			}
+			size := 0
+			if flags&hextileBackground != 0 {
+				size += bpp
+			}
+			if flags&hextileForeground != 0 {
+				size += bpp
+			}
+			if err = sr.skip(size); err != nil {
+				return err
+			}
+			if flags&hextileAnySubrects == 0 {
+				continue
+			}
+			if b, err = sr.next(1); err != nil {
+				return err
+			}
+			size = 2
+			if flags&hextileSubrectsColoured != 0 {
+				size += bpp
+			}
+			if err = sr.skip(int(b[0]) * size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func min16(n int) int {
+	if n > 16 {
+		return 16
+	}
+	return n
+}
+
+// rfb tight compression types and filters
+const (
+	tightFill     = 8
+	tightJPEG     = 9
+	tightFilter   = 4
+	tightCopy     = 0
+	tightPalette  = 1
+	tightGradient = 2
+)
+
+func (sr *serverReader) tight(w, h, tpixel int) error {
+	b, err := sr.next(1)
+	if err != nil {
+		return err
+	}
+	comp := b[0] >> 4
+	switch {
+	case comp == tightFill:
+		return sr.skip(tpixel)
+	case comp == tightJPEG:
+		return sr.tightData(-1)
+	case comp > tightJPEG:
+		return fmt.Errorf("rfb tight compression %d invalid", comp)
+	}
+
+	filter := byte(tightCopy)
+	if comp&tightFilter != 0 {
+		if b, err = sr.next(1); err != nil {
+			return err
+		}
+		filter = b[0]
+	}
+	size := w * h * tpixel
+	switch filter {
+	case tightCopy, tightGradient:
+	case tightPalette:
+		if b, err = sr.next(1); err != nil {
+			return err
+		}
+		colours := int(b[0]) + 1
+		if err = sr.skip(colours * tpixel); err != nil {
+			return err
+		}
+		size = w * h
+		if colours == 2 {
+			size = (w + 7) / 8 * h
+		}
+	default:
+		return fmt.Errorf("rfb tight filter %d invalid", filter)
+	}
+	return sr.tightData(size)
+}
+
+// tightData copy size bytes of data, which are compressed behind a compact
+// length when not less than 12, or a jpeg when size is -1
+func (sr *serverReader) tightData(size int) error {
+	if size >= 0 && size < 12 {
+		return sr.skip(size)
+	}
+	n := 0
+	for i := 0; i < 3; i++ {
+		b, err := sr.next(1)
+		if err != nil {
+			return err
+		}
+		if i == 2 {
+			n |= int(b[0]) << 14
+			break
+		}
+		n |= int(b[0]&0x7f) << uint(7*i)
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	return sr.skip(n)
+}
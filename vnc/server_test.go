@@ -0,0 +1,135 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestServerReaderRect(t *testing.T) {
+	tests := []struct {
+		name string
+		w, h int
+		e    int32
+		//pixel format of the server: bits per pixel, depth, true colour
+		pf   []byte
+		data []byte
+		err  bool
+	}{
+		{"raw", 2, 1, encodingRaw, []byte{32, 24, 0, 1}, []byte("RRRRGGGG"), false},
+		{"raw 16 bits", 2, 2, encodingRaw, []byte{16, 16, 0, 1}, []byte("11223344"), false},
+		{"copy rect", 8, 8, encodingCopyRect, []byte{32, 24, 0, 1}, []byte{0, 1, 0, 2}, false},
+		{"rre", 8, 8, encodingRRE, []byte{8, 8, 0, 0}, []byte{0, 0, 0, 1, 'b', 'f', 0, 0, 0, 0, 0, 1, 0, 1}, false},
+		{"hextile raw", 1, 1, encodingHextile, []byte{32, 24, 0, 1}, []byte{hextileRaw, 'H', 'H', 'H', 'H'}, false},
+		{"hextile subrects", 20, 1, encodingHextile, []byte{8, 8, 0, 0}, []byte{
+			hextileBackground | hextileAnySubrects | hextileSubrectsColoured, 'b', 2, 'c', 0, 0, 'c', 0, 0,
+			hextileForeground, 'f',
+		}, false},
+		{"zrle", 64, 64, encodingZRLE, []byte{32, 24, 0, 1}, []byte{0, 0, 0, 3, 'Z', 'Z', 'Z'}, false},
+		{"tight fill tpixel", 64, 64, encodingTight, []byte{32, 24, 0, 1}, []byte{tightFill << 4, 'T', 'T', 'T'}, false},
+		{"tight fill 32 bits", 64, 64, encodingTight, []byte{32, 32, 0, 1}, []byte{tightFill << 4, 'T', 'T', 'T', 'T'}, false},
+		{"tight jpeg", 64, 64, encodingTight, []byte{32, 24, 0, 1}, append([]byte{tightJPEG << 4, 0x81, 0x01}, make([]byte, 129)...), false},
+		{"tight copy small", 1, 2, encodingTight, []byte{32, 24, 0, 1}, []byte{0, 'a', 'b', 'c', 'd', 'e', 'f'}, false},
+		{"tight palette 2 colours", 16, 16, encodingTight, []byte{32, 24, 0, 1}, append([]byte{tightFilter << 4, tightPalette, 1, 1, 1, 1, 2, 2, 2, 32}, make([]byte, 32)...), false},
+		{"tight gradient", 4, 4, encodingTight, []byte{32, 24, 0, 1}, append([]byte{tightFilter << 4, tightGradient, 10}, make([]byte, 10)...), false},
+		{"tight compression invalid", 4, 4, encodingTight, []byte{32, 24, 0, 1}, []byte{0xa0}, true},
+		{"tight filter invalid", 4, 4, encodingTight, []byte{32, 24, 0, 1}, []byte{tightFilter << 4, 3}, true},
+		{"cursor", 8, 2, encodingCursor, []byte{8, 8, 0, 0}, append(make([]byte, 16), 0xff, 0xff), false},
+		{"desktop name", 0, 0, encodingDesktopName, []byte{32, 24, 0, 1}, []byte{0, 0, 0, 2, 'v', 'm'}, false},
+		{"extended desktop size", 32, 32, encodingExtendedDesktopSize, []byte{32, 24, 0, 1}, append([]byte{1, 0, 0, 0}, make([]byte, 16)...), false},
+		{"desktop size", 32, 32, encodingDesktopSize, []byte{32, 24, 0, 1}, nil, false},
+		{"unframed", 8, 8, -260, []byte{32, 24, 0, 1}, nil, true},
+		{"truncated", 2, 1, encodingRaw, []byte{32, 24, 0, 1}, []byte("RRRR"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//a trailing byte must be left unread
+			in := append(append([]byte{}, tt.data...), '!')
+			if tt.err {
+				in = tt.data
+			}
+			var out bytes.Buffer
+			pf := &pixelFormat{}
+			pf.set(tt.pf)
+			sr := &serverReader{r: bufio.NewReader(bytes.NewReader(in)), w: bufio.NewWriter(&out), pf: pf}
+			err := sr.rect(tt.w, tt.h, tt.e)
+			sr.w.Flush()
+			if tt.err {
+				if err == nil {
+					t.Fatalf("copied %x, want error", out.Bytes())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.data) {
+				t.Fatalf("copied %x, want %x", out.Bytes(), tt.data)
+			}
+			if b, _ := sr.r.ReadByte(); b != '!' {
+				t.Fatalf("next byte %q, want '!'", b)
+			}
+		})
+	}
+}
+
+// chunkReader return its chunks one per read, calling read before each but
+// the first
+type chunkReader struct {
+	chunks [][]byte
+	read   func()
+	n      int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if r.n > 0 && r.read != nil {
+		r.read()
+	}
+	r.n++
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestServerReaderPixelFormatChange(t *testing.T) {
+	rect := func(e int32) []byte {
+		b := []byte{0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[8:], uint32(e))
+		return b
+	}
+	//an update of two 32 bits rects, the browser changes to 8 bits after
+	//the first, then an update of one 8 bits rect
+	first := append(append([]byte{serverFramebufferUpdate, 0, 0, 2}, rect(encodingRaw)...), "RRRR"...)
+	second := append(rect(encodingRaw), "GGGG"...)
+	third := append(append([]byte{serverFramebufferUpdate, 0, 0, 1}, rect(encodingRaw)...), 'B', '!')
+
+	pf := &pixelFormat{}
+	pf.set([]byte{32, 24, 0, 1})
+	r := &chunkReader{chunks: [][]byte{first, second, third}}
+	r.read = func() { pf.change([]byte{8, 8, 0, 1}) }
+	var out bytes.Buffer
+	sr := &serverReader{r: bufio.NewReader(r), w: bufio.NewWriter(&out), pf: pf}
+	for i := 0; i < 2; i++ {
+		typ, err := sr.r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr.w.WriteByte(typ)
+		if err = sr.copyMessage(typ); err != nil {
+			t.Fatalf("update %d: %s", i, err)
+		}
+	}
+	sr.w.Flush()
+	want := append(append(append([]byte{}, first...), second...), third[:len(third)-1]...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("copied %x, want %x", out.Bytes(), want)
+	}
+	if b, _ := sr.r.ReadByte(); b != '!' {
+		t.Fatalf("next byte %q, want '!'", b)
+	}
+}
@@ -0,0 +1,53 @@
+package vnc
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/myml/webssh/common"
+)
+
+const (
+	//raw rfb in binary messages
+	ProtocolBinary = "binary"
+	//rfb encoded by base64 in text messages, for legacy websockify clients
+	ProtocolBase64 = "base64"
+)
+
+// Token of a websockify request, sent by clients in the query, as the last
+// element of the path or in the token cookie. Browsers send the cookie to
+// websockets opened by any site, it is only taken when origins are restricted
+func Token(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if i := strings.LastIndex(r.URL.Path, "/"); i > 0 && i < len(r.URL.Path)-1 {
+		return r.URL.Path[i+1:]
+	}
+	if !common.OriginsRestricted() {
+		return ""
+	}
+	if c, err := r.Cookie("token"); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Subprotocol negotiated with the client as websockify does, binary is
+// preferred and empty means the client offers none
+func Subprotocol(r *http.Request) (string, error) {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return "", nil
+	}
+	for _, p := range []string{ProtocolBinary, ProtocolBase64} {
+		for _, o := range offered {
+			if o == p {
+				return p, nil
+			}
+		}
+	}
+	return "", errors.New("client must support binary or base64 protocol")
+}